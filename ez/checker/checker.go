@@ -0,0 +1,446 @@
+package checker
+
+import (
+	"fmt"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+const STEP = "checking"
+
+type checker struct {
+	procs map[string]parser.Func
+	funcs map[string]vm.ExternalFunc
+
+	// Globals set up on the VM or assigned at the top level.
+	globals map[string]bool
+
+	diags lexer.Diagnostics
+}
+
+func (c *checker) report(token lexer.Token, message string, tip ...string) {
+	c.diags.Add(token.Error(STEP, message, tip...))
+}
+
+func (c *checker) warn(token lexer.Token, message string, tip ...string) {
+	c.diags.Add(token.Warning(STEP, message, tip...))
+}
+
+func exprVars(expr parser.Expr, vars []parser.Value) []parser.Value {
+	switch expr.Kind() {
+	case parser.ExprKindValue:
+		if val := expr.(parser.Value); val.Type == parser.ValueTypeVar {
+			vars = append(vars, val)
+		}
+	case parser.ExprKindUnary:
+		vars = exprVars(expr.(parser.UnaryExpr).Operand, vars)
+	case parser.ExprKindBinary:
+		binary := expr.(parser.BinaryExpr)
+		vars = exprVars(binary.Rhs, exprVars(binary.Lhs, vars))
+	case parser.ExprKindCall:
+		for _, arg := range expr.(parser.CallExpr).Args {
+			vars = exprVars(arg, vars)
+		}
+	}
+
+	return vars
+}
+
+func exprCalls(expr parser.Expr, calls []parser.CallExpr) []parser.CallExpr {
+	switch expr.Kind() {
+	case parser.ExprKindUnary:
+		calls = exprCalls(expr.(parser.UnaryExpr).Operand, calls)
+	case parser.ExprKindBinary:
+		binary := expr.(parser.BinaryExpr)
+		calls = exprCalls(binary.Rhs, exprCalls(binary.Lhs, calls))
+	case parser.ExprKindCall:
+		call := expr.(parser.CallExpr)
+		calls = append(calls, call)
+
+		for _, arg := range call.Args {
+			calls = exprCalls(arg, calls)
+		}
+	}
+
+	return calls
+}
+
+// stmtExprs returns the expressions a statement evaluates.
+func stmtExprs(stmt parser.Stmt) []parser.Expr {
+	switch stmt.Type() {
+	case parser.StmtTypeVarDecl:
+		return []parser.Expr{stmt.(parser.VarDecl).Value}
+	case parser.StmtTypeIf:
+		return []parser.Expr{stmt.(parser.If).Cond}
+	case parser.StmtTypeCall:
+		return stmt.(parser.Call).Args
+	case parser.StmtTypeReturn:
+		return []parser.Expr{stmt.(parser.Return).Value}
+	}
+
+	return nil
+}
+
+// outputs reports whether a builtin has parameters it writes to.
+func (c *checker) outputs(name string) bool {
+	if _, ok := c.procs[name]; ok {
+		return false
+	}
+
+	for _, param := range c.funcs[name].Signature {
+		if param.Kind == vm.ParamVar {
+			return true
+		}
+	}
+
+	return false
+}
+
+// effect returns the variables a statement reads and the ones it assigns.
+func (c *checker) effect(stmt parser.Stmt) ([]parser.Value, []string) {
+	reads := []parser.Value{}
+	defs := []string{}
+
+	if stmt.Type() == parser.StmtTypeCall && c.outputs(stmt.(parser.Call).Name) {
+		sig := c.funcs[stmt.(parser.Call).Name].Signature
+
+		for i, arg := range stmt.(parser.Call).Args {
+			param, _ := sig.Param(i)
+			if val, ok := arg.(parser.Value); ok && val.Type == parser.ValueTypeVar && param.Kind == vm.ParamVar {
+				defs = append(defs, val.Value)
+				continue
+			}
+
+			reads = exprVars(arg, reads)
+		}
+	} else {
+		for _, expr := range stmtExprs(stmt) {
+			reads = exprVars(expr, reads)
+		}
+	}
+
+	if decl, ok := stmt.(parser.VarDecl); ok {
+		defs = append(defs, decl.Name)
+	}
+
+	return reads, defs
+}
+
+func (c *checker) checkArgCount(name string, args int, token lexer.Token) {
+	if proc, ok := c.procs[name]; ok {
+		if args != len(proc.Params) {
+			c.report(token, fmt.Sprintf("incorrect number of arguments (expected %d, got %d)", len(proc.Params), args))
+		}
+
+		return
+	}
+
+	if fn, ok := c.funcs[name]; ok && !fn.Signature.Accepts(args) {
+		c.report(token, fmt.Sprintf("incorrect number of arguments (expected %s, got %d)", fn.Signature.Expected(), args))
+	}
+}
+
+// checkArgs reports arguments to a builtin that do not fit its signature.
+func (c *checker) checkArgs(fn vm.ExternalFunc, args []parser.Expr) {
+	for i, arg := range args {
+		if param, ok := fn.Signature.Param(i); !ok {
+			return
+		} else if err := param.Check(STEP, arg); err != nil {
+			c.diags.Add(err)
+		}
+	}
+}
+
+func (c *checker) checkCalls(stmt parser.Stmt) {
+	if call, ok := stmt.(parser.Call); ok {
+		_, isProc := c.procs[call.Name]
+		_, isFunc := c.funcs[call.Name]
+
+		if !isProc && !isFunc {
+			c.missing(call.Token, call.Name)
+		} else {
+			c.checkArgCount(call.Name, len(call.Args), call.Token)
+		}
+
+		if fn, ok := c.funcs[call.Name]; ok && !isProc {
+			c.checkArgs(fn, call.Args)
+		}
+	}
+
+	for _, expr := range stmtExprs(stmt) {
+		for _, call := range exprCalls(expr, nil) {
+			if _, ok := c.procs[call.Name]; ok {
+				c.checkArgCount(call.Name, len(call.Args), call.Token)
+				continue
+			}
+
+			if _, ok := c.funcs[call.Name]; ok {
+				c.report(call.Token, "builtin functions do not return a value", "Use 'call' to run builtin functions")
+				continue
+			}
+
+			c.missing(call.Token, call.Name)
+		}
+	}
+}
+
+// missing reports a call to a function that does not exist, or to a builtin
+// the VM was not granted the permission for.
+func (c *checker) missing(token lexer.Token, name string) {
+	if perm, ok := vm.PermissionFor(name); ok {
+		c.report(token, fmt.Sprintf("permission denied: %s needs the %s permission", name, perm), "The host running this program has not granted it")
+		return
+	}
+
+	c.report(token, "function does not exist")
+}
+
+func jumpTarget(stmt parser.Stmt) (parser.Goto, bool) {
+	switch stmt.Type() {
+	case parser.StmtTypeGoto:
+		return stmt.(parser.Goto), true
+	case parser.StmtTypeIf:
+		return stmt.(parser.If).Goto, true
+	case parser.StmtTypeGosub:
+		gosub := stmt.(parser.Gosub)
+		return parser.Goto{Name: gosub.Name, Token: gosub.Token}, true
+	}
+
+	return parser.Goto{}, false
+}
+
+// checkLabels reports duplicate and missing labels in one scope and returns
+// the statement index of each label.
+func (c *checker) checkLabels(stmts []parser.Stmt) map[string]int {
+	labels := map[string]int{}
+
+	for i, stmt := range stmts {
+		label, ok := stmt.(parser.Label)
+		if !ok {
+			continue
+		}
+
+		if first, ok := labels[label.Name]; ok {
+			line := stmts[first].(parser.Label).Token.Context.Line
+			c.report(label.Token, "duplicate label", fmt.Sprintf("'%s' is first defined on line %d", label.Name, line))
+			continue
+		}
+
+		labels[label.Name] = i
+	}
+
+	for _, stmt := range stmts {
+		if target, ok := jumpTarget(stmt); ok {
+			if _, ok := labels[target.Name]; !ok {
+				c.report(target.Token, "label does not exist")
+			}
+		}
+	}
+
+	return labels
+}
+
+// successors returns the statements control can reach next from stmts[i]. An
+// index of len(stmts) stands for leaving the scope.
+func successors(stmts []parser.Stmt, i int, labels map[string]int, inFunc bool) []int {
+	stmt := stmts[i]
+
+	switch stmt.Type() {
+	case parser.StmtTypeGoto, parser.StmtTypeGosub:
+		target, _ := jumpTarget(stmt)
+		if index, ok := labels[target.Name]; ok {
+			return []int{index}
+		}
+
+		return nil
+	case parser.StmtTypeIf:
+		target, _ := jumpTarget(stmt)
+		if index, ok := labels[target.Name]; ok {
+			return []int{i + 1, index}
+		}
+
+		return []int{i + 1}
+	case parser.StmtTypeReturn:
+		// A return can resume after any gosub in the scope, and one in a
+		// function can also leave it.
+		sites := []int{}
+		if inFunc {
+			sites = append(sites, len(stmts))
+		}
+
+		for j, other := range stmts {
+			if other.Type() == parser.StmtTypeGosub {
+				sites = append(sites, j+1)
+			}
+		}
+
+		return sites
+	}
+
+	return []int{i + 1}
+}
+
+// checkScope runs a definite-assignment analysis over a top-level or function
+// body, reporting reads of tracked variables that are not assigned on every
+// path leading to them. Untracked variables only have to be assigned somewhere.
+func (c *checker) checkScope(stmts []parser.Stmt, entry, tracked map[string]bool, inFunc bool) {
+	for _, stmt := range stmts {
+		c.checkCalls(stmt)
+	}
+
+	labels := c.checkLabels(stmts)
+
+	if len(stmts) == 0 {
+		return
+	}
+
+	in := make([]map[string]bool, len(stmts))
+	in[0] = entry
+
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		_, defs := c.effect(stmts[i])
+
+		out := map[string]bool{}
+		for name := range in[i] {
+			out[name] = true
+		}
+
+		for _, name := range defs {
+			out[name] = true
+		}
+
+		for _, next := range successors(stmts, i, labels, inFunc) {
+			if next >= len(stmts) {
+				continue
+			}
+
+			if in[next] == nil {
+				in[next] = out
+				work = append(work, next)
+				continue
+			}
+
+			changed := false
+			merged := map[string]bool{}
+			for name := range in[next] {
+				if out[name] {
+					merged[name] = true
+				} else {
+					changed = true
+				}
+			}
+
+			if changed {
+				in[next] = merged
+				work = append(work, next)
+			}
+		}
+	}
+
+	for i, stmt := range stmts {
+		if in[i] == nil {
+			continue
+		}
+
+		reads, _ := c.effect(stmt)
+
+		for _, read := range reads {
+			if !tracked[read.Value] {
+				if !c.globals[read.Value] {
+					c.report(read.Token, "variable does not exist")
+				}
+
+				continue
+			}
+
+			if !in[i][read.Value] {
+				c.warn(read.Token, "variable may be used before it is assigned")
+			}
+		}
+	}
+}
+
+func assigned(stmts []parser.Stmt, c *checker) map[string]bool {
+	names := map[string]bool{}
+
+	for _, stmt := range stmts {
+		_, defs := c.effect(stmt)
+
+		for _, name := range defs {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// Check analyses a program before it runs, against the builtins and global
+// variables already set up on the VM that will run it. Every problem found is
+// reported at once as lexer.Diagnostics: jumps to missing or duplicate labels,
+// calls to functions that do not exist and variables that do not exist are
+// errors, while variables that may be read before being assigned are warnings.
+func Check(program *parser.Program, executor *vm.VM) error {
+	c := &checker{
+		procs:   map[string]parser.Func{},
+		funcs:   executor.Funcs,
+		globals: map[string]bool{},
+	}
+
+	for _, stmt := range program.Stmts {
+		if fn, ok := stmt.(parser.Func); ok {
+			c.procs[fn.Name] = fn
+		}
+	}
+
+	predefined := map[string]bool{}
+	for _, name := range executor.Variables.Names() {
+		predefined[name] = true
+	}
+
+	locals := map[string]map[string]bool{}
+	for name, fn := range c.procs {
+		locals[name] = map[string]bool{}
+
+		for _, param := range fn.Params {
+			locals[name][param] = true
+		}
+
+		for local := range assigned(fn.Body, c) {
+			locals[name][local] = true
+		}
+	}
+
+	for name := range predefined {
+		c.globals[name] = true
+	}
+
+	for name := range assigned(program.Stmts, c) {
+		c.globals[name] = true
+	}
+
+	c.checkScope(program.Stmts, predefined, c.globals, false)
+
+	for _, stmt := range program.Stmts {
+		fn, ok := stmt.(parser.Func)
+		if !ok {
+			continue
+		}
+
+		params := map[string]bool{}
+		for _, param := range fn.Params {
+			params[param] = true
+		}
+
+		c.checkScope(fn.Body, params, locals[fn.Name], true)
+	}
+
+	c.diags.Sort()
+
+	return c.diags.Err()
+}
@@ -0,0 +1,174 @@
+package checker
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+// check returns the messages of the problems found in code.
+func check(t *testing.T, code string) []string {
+	t.Helper()
+
+	tokens, err := lexer.Lex(code, "test.ez")
+	if err != nil {
+		t.Fatalf("lexing %q: %v", code, err)
+	}
+
+	program, err := parser.Parse(tokens)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", code, err)
+	}
+
+	err = Check(program, vm.New(16))
+
+	var diags lexer.Diagnostics
+	if err != nil && !errors.As(err, &diags) {
+		t.Fatalf("checking %q: %v", code, err)
+	}
+
+	messages := []string{}
+	for _, diag := range diags {
+		messages = append(messages, diag.Message)
+	}
+
+	return messages
+}
+
+func TestOutputArgumentsInFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		messages []string
+	}{
+		{"local", "func f()\n  call memget 0 x\n  return x\nend\ny = f()", nil},
+		{"not global", "func f()\n  call memget 0 x\n  return x\nend\ny = f()\ncall shown x", []string{"variable does not exist"}},
+		{"read before written", "func f()\n  y = x\n  call memget 0 x\n  return y\nend\ny = f()", []string{"variable may be used before it is assigned"}},
+		{"shadows global", "x = 1\nfunc f()\n  call memget 0 x\n  return x\nend\ny = f() + x", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := check(t, test.code)
+
+			if len(messages) != len(test.messages) {
+				t.Fatalf("got %q, want %q", messages, test.messages)
+			}
+
+			for i := range messages {
+				if messages[i] != test.messages[i] {
+					t.Fatalf("got %q, want %q", messages, test.messages)
+				}
+			}
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	tests := map[string][]string{
+		":a\ngoto a":               nil,
+		"goto nowhere":             {"label does not exist"},
+		"x = 1\nif x goto nowhere": {"label does not exist"},
+		"gosub nowhere":            {"label does not exist"},
+		":a\n:a\ngoto a":           {"duplicate label"},
+		":a\nfunc f()\n  goto a\n  return 0\nend": {"label does not exist"},
+	}
+
+	for code, want := range tests {
+		if got := check(t, code); !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestCalls(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"call nothing 1", "function does not exist"},
+		{"x = nothing(1)", "function does not exist"},
+		{"call write_file \"x\" 0 1", "permission denied: write_file needs the fs-write permission"},
+		{"x = shown(1)", "builtin functions do not return a value"},
+		{"func f(a)\n  return a\nend\nx = f(1, 2)", "incorrect number of arguments (expected 1, got 2)"},
+		{"call memset 1", "incorrect number of arguments (expected 2, got 1)"},
+	}
+
+	for _, test := range tests {
+		if got := check(t, test.code); len(got) != 1 || got[0] != test.want {
+			t.Errorf("%q: got %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+// A read is only accepted if every path from the start of its scope assigns
+// the variable first.
+func TestDefiniteAssignment(t *testing.T) {
+	const maybe = "variable may be used before it is assigned"
+
+	tests := []struct {
+		name string
+		code string
+		want []string
+	}{
+		{"straight line", "x = 1\ncall shown x", nil},
+		{"never assigned", "call shown x", []string{"variable does not exist"}},
+		{"assigned later", "call shown x\nx = 1", []string{maybe}},
+		{"skipped by goto", "y = 0\nif y goto skip\nx = 1\n:skip\ncall shown x", []string{maybe}},
+		{"both branches", "y = 0\nif y then\n  x = 1\nelse\n  x = 2\nend\ncall shown x", nil},
+		{"one branch", "y = 0\nif y then\n  x = 1\nend\ncall shown x", []string{maybe}},
+		{"loop body", "for i = 1 to 3\n  x = i\nend\ncall shown x", []string{maybe}},
+		{"backward jump", "x = 0\n:loop\nx = x + 1\nif x < 3 goto loop", nil},
+		{"builtin output", "call memget 0 x\ncall shown x", nil},
+		{"gosub", "gosub set\ncall shown x\ngoto done\n:set\nx = 1\nreturn\n:done", nil},
+		{"unreachable", "goto done\ncall shown x\n:done", nil},
+		{"parameter", "func f(a)\n  return a + 1\nend\ny = f(1)", nil},
+		{"global in function", "g = 1\nfunc f()\n  return g\nend\ny = f()", nil},
+		{"local read first", "func f()\n  y = z\n  z = 1\n  return y\nend\ny = f()", []string{maybe}},
+		{"gosub in function", "func f()\n  gosub set\n  return x\n  :set\n  x = 1\n  return\nend\ny = f()", nil},
+		{"after gosub in function", "func f()\n  gosub sub\n  y = x\n  x = 1\n  return y\n  :sub\n  return\nend\ny = f()", []string{maybe}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := check(t, test.code); !slices.Equal(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReportsEverything(t *testing.T) {
+	got := check(t, "call shown x\ncall nothing\ngoto a")
+	want := []string{"variable does not exist", "function does not exist", "label does not exist"}
+
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// A read that may come before the assignment does not stop the program.
+func TestMaybeUnassignedIsWarning(t *testing.T) {
+	tokens, err := lexer.Lex("call shown x\nx = 1", "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	program, err := parser.Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var diags lexer.Diagnostics
+	if !errors.As(Check(program, vm.New(16)), &diags) || len(diags) != 1 {
+		t.Fatalf("got %v, want one warning", diags)
+	}
+
+	if diags[0].Severity != lexer.SeverityWarning || diags.HasErrors() {
+		t.Fatalf("severity %s, want %s", diags[0].Severity, lexer.SeverityWarning)
+	}
+}
@@ -0,0 +1,577 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vcokltfre/ez/ez"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+// The program runs as a single thread.
+const threadID = 1
+
+// Variable references. Locals of the frame with ID n use localsRef + n, and
+// pages of memory use pageRef + the page number.
+const (
+	globalsRef = 1
+	memoryRef  = 2
+	localsRef  = 1000
+	pageRef    = 1000000
+)
+
+// Number of memory cells in each page of the Memory scope.
+const pageSize = 256
+
+// Server is a debug adapter for a single session. The program runs on its own
+// goroutine and blocks in onStop while it is stopped, which is the only time
+// its state is read by the request handlers.
+type Server struct {
+	Memory   int
+	MaxDepth int
+
+	in  *bufio.Reader
+	out io.Writer
+
+	writeMu sync.Mutex
+	seq     int
+
+	// pending holds the breakpoints of each source by absolute path, until
+	// the program is launched.
+	pending    map[string][]sourceBreakpoint
+	program    string
+	debugger   *vm.Debugger
+	configured bool
+	launched   bool
+	running    bool
+	resuming   *vm.Action
+
+	mu      sync.Mutex
+	stopped bool
+	stop    vm.Stop
+	resume  chan vm.Action
+	done    chan struct{}
+}
+
+func NewServer(in io.Reader, out io.Writer, memory, maxDepth int) *Server {
+	return &Server{
+		Memory:   memory,
+		MaxDepth: maxDepth,
+		in:       bufio.NewReader(in),
+		out:      out,
+		pending:  map[string][]sourceBreakpoint{},
+		resume:   make(chan vm.Action),
+		done:     make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects.
+func (s *Server) Serve() error {
+	for {
+		req, err := readMessage(s.in)
+		if errors.Is(err, io.EOF) {
+			s.quit()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		body, err := s.handle(req)
+
+		res := response{
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			res.Message = err.Error()
+		}
+
+		if err := s.send(&res); err != nil {
+			return err
+		}
+
+		if s.resuming != nil {
+			s.resume <- *s.resuming
+			s.resuming = nil
+		}
+
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "launch", "configurationDone":
+			s.start()
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+func (s *Server) send(message any) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.seq++
+
+	switch m := message.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+
+	return writeMessage(s.out, message)
+}
+
+func (s *Server) event(name string, body any) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) output(category, text string) {
+	s.event("output", map[string]string{"category": category, "output": text})
+}
+
+func (s *Server) handle(req request) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}, nil
+	case "launch":
+		var args launchArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+
+		return nil, s.launch(args)
+	case "configurationDone":
+		s.configured = true
+		return nil, nil
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"breakpoints": s.setBreakpoints(args.Source, args.Breakpoints)}, nil
+	case "threads":
+		return map[string]any{"threads": []thread{{ID: threadID, Name: "main"}}}, nil
+	case "stackTrace":
+		frames, err := s.stackTrace()
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		var args frameArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+
+		scopes, err := s.scopes(args.FrameID)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"scopes": scopes}, nil
+	case "variables":
+		var args variablesArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+
+		vars, err := s.variables(args)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"variables": vars}, nil
+	case "evaluate":
+		var args evaluateArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+
+		if !s.isStopped() {
+			return nil, errors.New("the program is not stopped")
+		}
+
+		val, err := s.debugger.Eval(args.Expression)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{"result": strconv.FormatInt(val, 10), "variablesReference": 0}, nil
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, s.resumeWith(vm.ActionContinue)
+	case "next":
+		return nil, s.resumeWith(vm.ActionNext)
+	case "stepIn":
+		return nil, s.resumeWith(vm.ActionStep)
+	case "stepOut":
+		return nil, s.resumeWith(vm.ActionOut)
+	case "pause":
+		if s.debugger != nil {
+			s.debugger.Pause()
+		}
+
+		return nil, nil
+	case "disconnect", "terminate":
+		s.quit()
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported request: %s", req.Command)
+}
+
+// outputWriter sends program output to the client as output events.
+type outputWriter struct {
+	server *Server
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.server.output("stdout", string(p))
+	return len(p), nil
+}
+
+func (s *Server) launch(args launchArguments) error {
+	data, err := os.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+
+	executor := vm.New(s.Memory)
+	executor.MaxDepth = s.MaxDepth
+	executor.Stdout = outputWriter{server: s}
+	executor.Stdin = strings.NewReader("")
+	executor.Grant(vm.Unrestricted())
+
+	program, warnings, err := ez.Load(string(data), args.Program, executor)
+	if err != nil {
+		s.output("stderr", err.Error()+"\n")
+		return errors.New("the program has errors, see the debug console")
+	}
+
+	if len(warnings) > 0 {
+		s.output("console", warnings.Error()+"\n")
+	}
+
+	s.debugger = vm.NewDebugger(executor, vm.Compile(program, executor.Funcs))
+	s.debugger.StopOnEntry = args.StopOnEntry
+	s.debugger.OnStop = s.onStop
+	s.launched = true
+	s.program = absolute(args.Program)
+
+	s.setBreakpoints(source{Path: s.program}, s.pending[s.program])
+
+	return nil
+}
+
+// start runs the program once it has been launched and configured.
+func (s *Server) start() {
+	if !s.launched || !s.configured || s.running {
+		return
+	}
+
+	s.running = true
+
+	go func() {
+		defer close(s.done)
+
+		err := s.debugger.Run()
+
+		exitCode := 0
+		if err != nil && !errors.Is(err, vm.ErrDebugQuit) {
+			exitCode = 1
+			s.output("stderr", err.Error()+"\n")
+		}
+
+		s.event("exited", map[string]int{"exitCode": exitCode})
+		s.event("terminated", nil)
+	}()
+}
+
+func (s *Server) onStop(stop vm.Stop) vm.Action {
+	s.mu.Lock()
+	s.stopped = true
+	s.stop = stop
+	s.mu.Unlock()
+
+	body := map[string]any{
+		"reason":            string(stop.Reason),
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+
+	switch stop.Reason {
+	case vm.StopBreakpoint:
+		body["hitBreakpointIds"] = []int{stop.ID}
+	case vm.StopWatchpoint:
+		body["reason"] = "data breakpoint"
+	}
+
+	if stop.Message != "" {
+		body["description"] = stop.Message
+		body["text"] = stop.Message
+	}
+
+	s.event("stopped", body)
+
+	return <-s.resume
+}
+
+func (s *Server) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stopped
+}
+
+func (s *Server) resumeWith(action vm.Action) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.mu.Unlock()
+		return errors.New("the program is not stopped")
+	}
+	s.stopped = false
+	s.mu.Unlock()
+
+	// The program resumes once the response has been sent, so that its next
+	// stopped event cannot overtake the response.
+	s.resuming = &action
+
+	return nil
+}
+
+// quit stops the program if it is running and waits for it to finish.
+func (s *Server) quit() {
+	if !s.running {
+		return
+	}
+
+	s.debugger.Pause()
+
+	for {
+		select {
+		case s.resume <- vm.ActionQuit:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// absolute returns the absolute form of path, or path itself if it has none,
+// so that the paths of a source can be compared.
+func absolute(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return path
+}
+
+// setBreakpoints replaces the breakpoints of src. Only the launched program
+// can have breakpoints, so those in any other source are left unverified.
+func (s *Server) setBreakpoints(src source, requested []sourceBreakpoint) []breakpoint {
+	path := absolute(src.Path)
+	s.pending[path] = requested
+
+	result := []breakpoint{}
+
+	if s.debugger == nil || path != s.program {
+		message := "waiting for launch"
+		if s.debugger != nil {
+			message = "not the program being debugged"
+		}
+
+		for _, bp := range requested {
+			result = append(result, breakpoint{Verified: false, Line: bp.Line, Message: message})
+		}
+
+		return result
+	}
+
+	s.debugger.ClearBreakpoints()
+
+	for _, req := range requested {
+		bp, err := s.debugger.AddBreakpoint(req.Line, req.Condition)
+		if err != nil {
+			result = append(result, breakpoint{Verified: false, Line: req.Line, Message: err.Error()})
+			continue
+		}
+
+		result = append(result, breakpoint{ID: bp.ID, Verified: true, Line: bp.Line})
+	}
+
+	return result
+}
+
+// stackTrace lists the frames innermost first. Frame 0 is where the program
+// stopped and each other frame is at the call into the frame before it.
+func (s *Server) stackTrace() ([]stackFrame, error) {
+	s.mu.Lock()
+	stopped, ctx := s.stopped, s.stop.Context
+	s.mu.Unlock()
+
+	if !stopped {
+		return nil, errors.New("the program is not stopped")
+	}
+
+	frames := s.debugger.VM.Frames()
+
+	src := source{Name: filepath.Base(ctx.File()), Path: absolute(ctx.File())}
+
+	name := func(i int) string {
+		if i < 0 {
+			return "main"
+		}
+
+		return frames[i].Name
+	}
+
+	result := []stackFrame{{ID: 0, Name: name(len(frames) - 1), Source: src, Line: ctx.Line, Column: ctx.Column}}
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		caller := frames[i].Caller
+
+		result = append(result, stackFrame{
+			ID:     len(frames) - i,
+			Name:   name(i - 1),
+			Source: src,
+			Line:   caller.Line,
+			Column: caller.Column,
+		})
+	}
+
+	return result, nil
+}
+
+// frameLocals returns the local variables of the frame with the given ID, or
+// nil if the frame runs at the top level.
+func (s *Server) frameLocals(id int) map[string]int64 {
+	frames := s.debugger.VM.Frames()
+
+	index := len(frames) - 1 - id
+	if index < 0 || index >= len(frames) {
+		return nil
+	}
+
+	locals := frames[index].Locals()
+	if len(locals) == 0 {
+		return nil
+	}
+
+	return locals
+}
+
+func (s *Server) scopes(frameID int) ([]scope, error) {
+	if !s.isStopped() {
+		return nil, errors.New("the program is not stopped")
+	}
+
+	scopes := []scope{}
+
+	if s.frameLocals(frameID) != nil {
+		scopes = append(scopes, scope{Name: "Locals", VariablesReference: localsRef + frameID})
+	}
+
+	return append(scopes,
+		scope{Name: "Globals", VariablesReference: globalsRef},
+		scope{Name: "Memory", VariablesReference: memoryRef, IndexedVariables: len(s.debugger.VM.Memory), Expensive: true},
+	), nil
+}
+
+func (s *Server) variables(args variablesArguments) ([]variable, error) {
+	if !s.isStopped() {
+		return nil, errors.New("the program is not stopped")
+	}
+
+	memory := s.debugger.VM.Memory
+	ref := args.VariablesReference
+
+	switch {
+	case ref == globalsRef:
+		return namedVariables(s.debugger.VM.Variables.Map()), nil
+	case ref == memoryRef && args.Count > 0:
+		return cells(memory, args.Start, args.Start+args.Count), nil
+	case ref == memoryRef:
+		// Clients that do not page indexed variables get the memory in pages.
+		pages := []variable{}
+
+		for start := 0; start < len(memory); start += pageSize {
+			end := min(start+pageSize, len(memory))
+
+			pages = append(pages, variable{
+				Name:               fmt.Sprintf("[%d..%d]", start, end-1),
+				VariablesReference: pageRef + start/pageSize,
+				IndexedVariables:   end - start,
+			})
+		}
+
+		return pages, nil
+	case ref >= pageRef:
+		start := (ref - pageRef) * pageSize
+		if args.Count > 0 {
+			start += args.Start
+			return cells(memory, start, min(start+args.Count, (ref-pageRef+1)*pageSize)), nil
+		}
+
+		return cells(memory, start, start+pageSize), nil
+	case ref >= localsRef:
+		return namedVariables(s.frameLocals(ref - localsRef)), nil
+	}
+
+	return nil, fmt.Errorf("unknown variables reference: %d", ref)
+}
+
+func namedVariables(vars map[string]int64) []variable {
+	result := []variable{}
+
+	for _, name := range sortedNames(vars) {
+		result = append(result, variable{Name: name, Value: strconv.FormatInt(vars[name], 10)})
+	}
+
+	return result
+}
+
+func cells(memory []int64, start, end int) []variable {
+	result := []variable{}
+
+	for addr := max(start, 0); addr < min(end, len(memory)); addr++ {
+		result = append(result, variable{Name: strconv.Itoa(addr), Value: strconv.FormatInt(memory[addr], 10)})
+	}
+
+	return result
+}
+
+// sortedNames returns the variable names in order, leaving out the variables
+// generated for block statements.
+func sortedNames(vars map[string]int64) []string {
+	names := []string{}
+
+	for name := range vars {
+		if !strings.HasPrefix(name, "__") || name == "__memsize" {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	return names
+}
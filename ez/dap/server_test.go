@@ -0,0 +1,209 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// message is a response or event read by the test client.
+type message struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type client struct {
+	t        *testing.T
+	in       io.Writer
+	seq      int
+	messages chan message
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+
+	c := &client{t: t, in: clientOut, messages: make(chan message, 100)}
+
+	server := NewServer(serverIn, serverOut, 64, 100)
+	go func() {
+		server.Serve()
+		serverOut.Close()
+	}()
+
+	go func() {
+		defer close(c.messages)
+
+		r := bufio.NewReader(clientIn)
+		for {
+			var length int
+			if _, err := fmt.Fscanf(r, "Content-Length: %d\r\n\r\n", &length); err != nil {
+				return
+			}
+
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+
+			var m message
+			if err := json.Unmarshal(body, &m); err != nil {
+				return
+			}
+
+			c.messages <- m
+		}
+	}()
+
+	t.Cleanup(func() { clientOut.Close() })
+
+	return c
+}
+
+// request sends a request and returns its response.
+func (c *client) request(command string, args any) message {
+	c.t.Helper()
+
+	c.seq++
+	if err := writeMessage(c.in, map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args}); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.wait(func(m message) bool { return m.Type == "response" && m.RequestSeq == c.seq })
+}
+
+// event waits for an event with the given name.
+func (c *client) event(name string) message {
+	c.t.Helper()
+
+	return c.wait(func(m message) bool { return m.Type == "event" && m.Event == name })
+}
+
+func (c *client) wait(match func(message) bool) message {
+	c.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				c.t.Fatal("the server closed the connection")
+			}
+
+			if match(m) {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+func writeProgram(t *testing.T, code string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.ez")
+	if err := os.WriteFile(path, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestSession(t *testing.T) {
+	program := writeProgram(t, "x = 1\nx = x + 1\ncall shown x\n")
+	c := newClient(t)
+
+	if res := c.request("initialize", nil); !res.Success {
+		t.Fatalf("initialize failed: %s", res.Message)
+	}
+
+	c.event("initialized")
+
+	res := c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": program},
+		"breakpoints": []map[string]any{{"line": 2}},
+	})
+
+	var breakpoints struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(res.Body, &breakpoints); err != nil || len(breakpoints.Breakpoints) != 1 {
+		t.Fatalf("setBreakpoints = %s, %v", res.Body, err)
+	}
+
+	if res := c.request("launch", map[string]any{"program": program}); !res.Success {
+		t.Fatalf("launch failed: %s", res.Message)
+	}
+
+	// Breakpoints in another file are not verified and leave the program's
+	// breakpoints alone.
+	res = c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": filepath.Join(filepath.Dir(program), "other.ez")},
+		"breakpoints": []map[string]any{{"line": 1}},
+	})
+	if err := json.Unmarshal(res.Body, &breakpoints); err != nil || len(breakpoints.Breakpoints) != 1 || breakpoints.Breakpoints[0].Verified {
+		t.Fatalf("setBreakpoints in another file = %s, %v", res.Body, err)
+	}
+
+	c.request("configurationDone", nil)
+	c.event("stopped")
+
+	res = c.request("evaluate", map[string]any{"expression": "x * 10"})
+
+	var result struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(res.Body, &result); err != nil || result.Result != "10" {
+		t.Fatalf("evaluate = %s, %v; want 10", res.Body, err)
+	}
+
+	c.request("continue", nil)
+
+	output := c.event("output")
+	if string(output.Body) != `{"category":"stdout","output":"2"}` {
+		t.Fatalf("output = %s", output.Body)
+	}
+
+	exited := c.event("exited")
+	if string(exited.Body) != `{"exitCode":0}` {
+		t.Fatalf("exited = %s", exited.Body)
+	}
+
+	c.request("disconnect", nil)
+}
+
+func TestLaunchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+	}{
+		{"missing file", filepath.Join(t.TempDir(), "missing.ez")},
+		{"checking error", writeProgram(t, "goto nowhere\n")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newClient(t)
+			c.request("initialize", nil)
+
+			if res := c.request("launch", map[string]any{"program": test.program}); res.Success {
+				t.Fatal("launch succeeded; want an error")
+			}
+
+			c.request("disconnect", nil)
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez"
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/render"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+const prompt = "(ezdb) "
+
+const help = `  s, step              run to the next line, entering calls
+  n, next              run to the next line, stepping over calls
+  o, out               run until the current function or gosub returns
+  c, continue          run until a breakpoint or watchpoint
+  q, quit              stop the program
+  b, break <line> [if <cond>]
+                       stop at a line, optionally only when cond is non-zero
+  w, watch <var>       stop when a variable changes
+  w, watch mem <addr>  stop when a memory cell changes
+  d, delete <id>       remove a breakpoint or watchpoint
+  i, info              list breakpoints and watchpoints
+  p, print <expr>      evaluate an expression
+  vars                 show global variables
+  locals               show the variables of the current function
+  mem <addr> <len>     show memory cells
+  bt, stack            show the call stack
+  jumps [n]            show the last n jumps (default 10)
+  l, list              show the source around the current line
+`
+
+// CLI is an interactive command-line front end for vm.Debugger. The program
+// reads its input from the same reader as the commands, so a line typed while
+// it runs goes to the program and one typed at the prompt is a command.
+type CLI struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	debugger *vm.Debugger
+	stop     vm.Stop
+}
+
+// Run debugs a program interactively, stopping before its first statement.
+func Run(in io.Reader, out io.Writer, code, filename string, memory, maxDepth int, format render.Format) error {
+	reader := bufio.NewReader(in)
+
+	executor := vm.New(memory)
+	executor.MaxDepth = maxDepth
+	executor.Stdin = reader
+	executor.Stdout = out
+	executor.Grant(vm.Unrestricted())
+
+	program, warnings, err := ez.Load(code, filename, executor)
+	if err != nil {
+		return err
+	}
+
+	if len(warnings) > 0 {
+		if err := render.Write(out, format, warnings); err != nil {
+			return err
+		}
+	}
+
+	cli := &CLI{
+		in:       reader,
+		out:      out,
+		debugger: vm.NewDebugger(executor, vm.Compile(program, executor.Funcs)),
+	}
+	cli.debugger.StopOnEntry = true
+	cli.debugger.OnStop = cli.onStop
+
+	err = cli.debugger.Run()
+	if errors.Is(err, vm.ErrDebugQuit) {
+		return nil
+	}
+
+	if err != nil {
+		diags := lexer.Diagnostics{}
+		diags.Add(err)
+
+		fmt.Fprintln(out)
+
+		return render.Write(out, format, diags)
+	}
+
+	fmt.Fprintln(out, "\nprogram finished")
+
+	return nil
+}
+
+func (c *CLI) onStop(stop vm.Stop) vm.Action {
+	c.stop = stop
+
+	fmt.Fprintln(c.out)
+	if stop.Message != "" {
+		fmt.Fprintf(c.out, "%s: %s\n", stop.Reason, stop.Message)
+	}
+	c.showLine(stop.Context.Line, "=>")
+
+	for {
+		fmt.Fprint(c.out, prompt)
+
+		line, err := c.in.ReadString('\n')
+		if err != nil && line == "" {
+			return vm.ActionQuit
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if action, ok := c.command(fields[0], fields[1:]); ok {
+			return action
+		}
+	}
+}
+
+// command runs a debugger command, returning true along with an action for
+// the commands that resume the program.
+func (c *CLI) command(name string, args []string) (vm.Action, bool) {
+	switch name {
+	case "s", "step":
+		return vm.ActionStep, true
+	case "n", "next":
+		return vm.ActionNext, true
+	case "o", "out":
+		return vm.ActionOut, true
+	case "c", "continue":
+		return vm.ActionContinue, true
+	case "q", "quit":
+		return vm.ActionQuit, true
+	case "b", "break":
+		c.addBreakpoint(args)
+	case "w", "watch":
+		c.addWatchpoint(args)
+	case "d", "delete":
+		id, err := strconv.Atoi(strings.Join(args, ""))
+		if err != nil || !c.debugger.Remove(id) {
+			fmt.Fprintln(c.out, "no breakpoint or watchpoint with that id")
+		}
+	case "i", "info":
+		c.info()
+	case "p", "print":
+		val, err := c.debugger.Eval(strings.Join(args, " "))
+		if err != nil {
+			fmt.Fprintln(c.out, err)
+			break
+		}
+
+		fmt.Fprintln(c.out, val)
+	case "vars":
+		c.showVars(c.debugger.VM.Variables.Map())
+	case "locals":
+		frames := c.debugger.VM.Frames()
+		if len(frames) == 0 {
+			fmt.Fprintln(c.out, "not in a function")
+			break
+		}
+
+		c.showVars(frames[len(frames)-1].Locals())
+	case "mem":
+		c.mem(args)
+	case "bt", "stack":
+		c.stack()
+	case "jumps":
+		c.jumps(args)
+	case "l", "list":
+		for line := c.stop.Context.Line - 3; line <= c.stop.Context.Line+3; line++ {
+			marker := "  "
+			if line == c.stop.Context.Line {
+				marker = "=>"
+			}
+
+			c.showLine(line, marker)
+		}
+	case "h", "help":
+		fmt.Fprint(c.out, help)
+	default:
+		fmt.Fprintf(c.out, "unknown command: %s (try help)\n", name)
+	}
+
+	return 0, false
+}
+
+func (c *CLI) showLine(line int, marker string) {
+	source := c.stop.Context.Source
+	if source == nil || line < 1 || line > strings.Count(source.Code, "\n")+1 {
+		return
+	}
+
+	fmt.Fprintf(c.out, "%s %4d | %s\n", marker, line, source.Line(line))
+}
+
+func (c *CLI) addBreakpoint(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(c.out, "usage: break <line> [if <cond>]")
+		return
+	}
+
+	line, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintln(c.out, "invalid line:", args[0])
+		return
+	}
+
+	condition := ""
+	if len(args) > 1 {
+		if args[1] != "if" || len(args) == 2 {
+			fmt.Fprintln(c.out, "usage: break <line> [if <cond>]")
+			return
+		}
+
+		condition = strings.Join(args[2:], " ")
+	}
+
+	bp, err := c.debugger.AddBreakpoint(line, condition)
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return
+	}
+
+	fmt.Fprintf(c.out, "breakpoint %d at line %d\n", bp.ID, bp.Line)
+}
+
+func (c *CLI) addWatchpoint(args []string) {
+	var w *vm.Watchpoint
+
+	switch {
+	case len(args) == 1:
+		w = c.debugger.WatchVar(args[0])
+	case len(args) == 2 && args[0] == "mem":
+		addr, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintln(c.out, "invalid address:", args[1])
+			return
+		}
+
+		w, err = c.debugger.WatchMemory(addr)
+		if err != nil {
+			fmt.Fprintln(c.out, err)
+			return
+		}
+	default:
+		fmt.Fprintln(c.out, "usage: watch <var> | watch mem <addr>")
+		return
+	}
+
+	fmt.Fprintf(c.out, "watchpoint %d on %s\n", w.ID, w)
+}
+
+func (c *CLI) info() {
+	for _, bp := range c.debugger.Breakpoints() {
+		fmt.Fprintf(c.out, "%d: breakpoint at line %d", bp.ID, bp.Line)
+		if bp.Condition != "" {
+			fmt.Fprintf(c.out, " if %s", bp.Condition)
+		}
+		fmt.Fprintf(c.out, " (hit %d times)\n", bp.Hits)
+	}
+
+	for _, w := range c.debugger.Watchpoints() {
+		fmt.Fprintf(c.out, "%d: watchpoint on %s\n", w.ID, w)
+	}
+}
+
+func (c *CLI) showVars(vars map[string]int64) {
+	names := []string{}
+	for name := range vars {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(c.out, "%s = %d\n", name, vars[name])
+	}
+}
+
+func (c *CLI) mem(args []string) {
+	memory := c.debugger.VM.Memory
+
+	if len(args) != 2 {
+		fmt.Fprintln(c.out, "usage: mem <addr> <len>")
+		return
+	}
+
+	addr, err1 := strconv.Atoi(args[0])
+	length, err2 := strconv.Atoi(args[1])
+	if err1 != nil || err2 != nil || addr < 0 || addr >= len(memory) || length < 0 {
+		fmt.Fprintf(c.out, "invalid range (memory has %d cells)\n", len(memory))
+		return
+	}
+
+	end := min(addr+length, len(memory))
+
+	for row := addr; row < end; row += 8 {
+		fmt.Fprintf(c.out, "%6d:", row)
+
+		for i := row; i < min(row+8, end); i++ {
+			fmt.Fprintf(c.out, " %d", memory[i])
+		}
+
+		fmt.Fprintln(c.out)
+	}
+}
+
+func (c *CLI) stack() {
+	frames := c.debugger.VM.Frames()
+
+	name := "main"
+	if len(frames) > 0 {
+		name = frames[len(frames)-1].Name
+	}
+
+	fmt.Fprintf(c.out, "#0 %s, line %d\n", name, c.stop.Context.Line)
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		caller := "main"
+		if i > 0 {
+			caller = frames[i-1].Name
+		}
+
+		fmt.Fprintf(c.out, "#%d %s, line %d\n", len(frames)-i, caller, frames[i].Caller.Line)
+	}
+}
+
+func (c *CLI) jumps(args []string) {
+	count := 10
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintln(c.out, "invalid count:", args[0])
+			return
+		}
+
+		count = n
+	}
+
+	jumps := c.debugger.Jumps()
+	jumps = jumps[max(len(jumps)-count, 0):]
+
+	for _, jump := range jumps {
+		fmt.Fprintf(c.out, "line %d -> line %d", jump.From.Line, jump.To.Line)
+		if jump.Label != "" && !strings.HasPrefix(jump.Label, "__") {
+			fmt.Fprintf(c.out, " (:%s)", jump.Label)
+		}
+		fmt.Fprintln(c.out)
+	}
+}
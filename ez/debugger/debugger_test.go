@@ -0,0 +1,91 @@
+package debugger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/render"
+)
+
+const source = `x = 1
+func f(a)
+    b = a * 2
+    return b
+end
+y = f(x + 1)
+call memset 2 y
+z = 0
+`
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands string
+		want     []string
+	}{
+		{"continue", "c\n", []string{"=>    1 | x = 1", "program finished"}},
+		{"quit", "q\n", []string{"=>    1 | x = 1"}},
+		{"step into function", "s\ns\ns\n", []string{"=>    3 |     b = a * 2"}},
+		{"print", "s\np x * 10\nq\n", []string{"10"}},
+		{"breakpoint", "b 4\nc\nlocals\nbt\nq\n", []string{"=>    4 |     return b", "a = 2\nb = 4", "#0 f, line 4\n#1 main, line 6"}},
+		{"conditional breakpoint", "b 7 if y == 4\nc\np y\nq\n", []string{"=>    7 | call memset 2 y", "4"}},
+		{"memory", "b 7\nc\nn\nmem 2 1\nq\n", []string{"     2: 4"}},
+		{"unknown command", "frobnicate\nq\n", []string{"unknown command: frobnicate"}},
+		{"end of input", "", []string{"=>    1 | x = 1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+
+			err := Run(strings.NewReader(test.commands), &out, source, "test.ez", 16, 100, render.FormatText)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	err := Run(strings.NewReader(""), &strings.Builder{}, "goto nowhere", "test.ez", 16, 100, render.FormatText)
+	if err == nil || !strings.Contains(err.Error(), "label does not exist") {
+		t.Fatalf("got %v, want a checking error", err)
+	}
+}
+
+// The program shares the session's streams: input typed after a command that
+// resumes it is read by the program rather than taken as the next command.
+func TestProgramIO(t *testing.T) {
+	var out strings.Builder
+
+	err := Run(strings.NewReader("n\nA\nvars\nq\n"), &out, "call input c\ncall shown c\nx = 0", "test.ez", 16, 100, render.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "c = 65") {
+		t.Fatalf("program did not read its input from the session:\n%s", out.String())
+	}
+
+	if strings.Contains(out.String(), "unknown command") {
+		t.Fatalf("program input was taken as a command:\n%s", out.String())
+	}
+}
+
+func TestProgramOutput(t *testing.T) {
+	var out strings.Builder
+
+	if err := Run(strings.NewReader("c\n"), &out, "call shown 42", "test.ez", 16, 100, render.FormatText); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "42") {
+		t.Fatalf("program output was not written to the session:\n%s", out.String())
+	}
+}
@@ -0,0 +1,165 @@
+package ez
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+// DefaultMemory is the number of memory cells a program gets when Options
+// does not say.
+const DefaultMemory = 1 << 16
+
+// Options configure the VMs an Engine runs programs on. Unset I/O is empty
+// rather than the process's own, so an embedded program cannot read or write
+// the host's standard streams unless it is given them.
+type Options struct {
+	Memory   int
+	MaxDepth int
+
+	// Limits on a run, unlimited if zero. See the fields of vm.VM.
+	MaxSteps     int64
+	MaxVariables int
+	MaxMemory    int
+	Timeout      time.Duration
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Permissions are the capabilities programs are granted. None are by
+	// default: use vm.Unrestricted to trust programs like the ez command does.
+	Permissions vm.Permissions
+
+	// Setup, if set, is called on every new VM, for example to register host
+	// functions. Programs are checked against the functions it registers.
+	Setup func(*vm.VM)
+}
+
+// Engine compiles programs and runs them with a fixed set of options. It is
+// safe for concurrent use: every run gets a fresh VM.
+type Engine struct {
+	opts Options
+}
+
+func NewEngine(opts Options) *Engine {
+	if opts.Memory <= 0 {
+		opts.Memory = DefaultMemory
+	}
+
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = vm.DefaultMaxDepth
+	}
+
+	if opts.Stdin == nil {
+		opts.Stdin = strings.NewReader("")
+	}
+
+	if opts.Stdout == nil {
+		opts.Stdout = io.Discard
+	}
+
+	if opts.Stderr == nil {
+		opts.Stderr = io.Discard
+	}
+
+	return &Engine{opts: opts}
+}
+
+// NewVM returns a VM set up with the engine's options.
+func (e *Engine) NewVM() *vm.VM {
+	executor := vm.New(e.opts.Memory)
+	executor.MaxDepth = e.opts.MaxDepth
+	executor.MaxSteps = e.opts.MaxSteps
+	executor.MaxVariables = e.opts.MaxVariables
+	executor.MaxMemory = e.opts.MaxMemory
+	executor.Stdin = e.opts.Stdin
+	executor.Stdout = e.opts.Stdout
+	executor.Stderr = e.opts.Stderr
+
+	executor.Grant(e.opts.Permissions)
+
+	if e.opts.Setup != nil {
+		e.opts.Setup(executor)
+	}
+
+	return executor
+}
+
+// Program is a compiled program. Running it does not modify it, so it can be
+// run any number of times, including concurrently.
+type Program struct {
+	engine *Engine
+	syntax *parser.Program
+	code   *vm.Code
+
+	warnings lexer.Diagnostics
+}
+
+// Compile lexes, parses and checks code and compiles it for the engine.
+func (e *Engine) Compile(code, filename string) (*Program, error) {
+	executor := e.NewVM()
+
+	program, warnings, err := Load(code, filename, executor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{
+		engine:   e,
+		syntax:   program,
+		code:     vm.Compile(program, executor.Funcs),
+		warnings: warnings,
+	}, nil
+}
+
+// Compile compiles code for a new engine with the given options.
+func Compile(code, filename string, opts Options) (*Program, error) {
+	return NewEngine(opts).Compile(code, filename)
+}
+
+// Syntax returns the parsed program.
+func (p *Program) Syntax() *parser.Program {
+	return p.syntax
+}
+
+// Warnings returns the problems found while checking the program that do not
+// stop it from running, such as a variable that may be read before it is
+// assigned.
+func (p *Program) Warnings() lexer.Diagnostics {
+	return p.warnings
+}
+
+// Code returns the compiled program, which can be run with Exec on any VM
+// with the engine's builtins.
+func (p *Program) Code() *vm.Code {
+	return p.code
+}
+
+// Run runs the program on a fresh VM from its engine.
+func (p *Program) Run() error {
+	return p.RunContext(context.Background())
+}
+
+// RunContext runs the program on a fresh VM from its engine, stopping when ctx
+// is done or the engine's timeout passes.
+func (p *Program) RunContext(ctx context.Context) error {
+	return p.RunOn(ctx, p.engine.NewVM())
+}
+
+// RunOn runs the program on the given VM, such as one from Engine.NewVM with
+// its I/O replaced for this run.
+func (p *Program) RunOn(ctx context.Context, executor *vm.VM) error {
+	if p.engine.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.engine.opts.Timeout)
+		defer cancel()
+	}
+
+	return executor.ExecContext(ctx, p.code)
+}
@@ -0,0 +1,159 @@
+package ez
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+func TestHostIO(t *testing.T) {
+	var out strings.Builder
+
+	program, err := Compile("call input c\ncall shown c + 1", "test.ez", Options{
+		Stdin:  strings.NewReader("A"),
+		Stdout: &out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := program.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "66" {
+		t.Fatalf("output %q, want %q", out.String(), "66")
+	}
+}
+
+func TestDefaultIOIsEmpty(t *testing.T) {
+	engine := NewEngine(Options{})
+
+	program, err := engine.Compile("call input c", "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := engine.NewVM()
+	if err := program.RunOn(context.Background(), executor); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, _ := executor.Variables.Get("c"); c != -1 {
+		t.Fatalf("input read %d from the default stdin, want -1 for its end", c)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	engine := NewEngine(Options{Setup: func(executor *vm.VM) {
+		executor.RegisterFunc("answer", vm.Signature{vm.Out("var")}, func(ctx lexer.TokenContext, args []vm.Arg) error {
+			args[0].Var.Set(42)
+			return nil
+		})
+	}})
+
+	if _, err := engine.Compile("call missing", "test.ez"); err == nil {
+		t.Fatal("compiled a call to a function Setup did not register")
+	}
+
+	program, err := engine.Compile("call answer a", "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := engine.NewVM()
+	if err := program.RunOn(context.Background(), executor); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, _ := executor.Variables.Get("a"); a != 42 {
+		t.Fatalf("a = %d, want 42", a)
+	}
+}
+
+// A compiled program is shared by every run, each on its own VM.
+func TestConcurrentRuns(t *testing.T) {
+	program, err := Compile("func sum(n)\n  s = 0\n  for i = 1 to n\n    s += i\n  end\n  return s\nend\ncall memget 0 n\ncall shown sum(n)", "test.ez", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	outputs := make([]strings.Builder, 8)
+
+	for i := range outputs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			executor := program.engine.NewVM()
+			executor.Stdout = &outputs[i]
+			executor.Memory[0] = int64(i * 100)
+
+			if err := program.RunOn(context.Background(), executor); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range outputs {
+		n := i * 100
+		if want := fmt.Sprint(n * (n + 1) / 2); outputs[i].String() != want {
+			t.Errorf("run %d printed %q, want %q", i, outputs[i].String(), want)
+		}
+	}
+}
+
+func TestNoPermissionsByDefault(t *testing.T) {
+	_, err := Compile("call write_file \"x\" 0 1", "test.ez", Options{})
+	if err == nil || !strings.Contains(err.Error(), "permission denied: write_file needs the fs-write permission") {
+		t.Fatalf("got %v, want a permission error", err)
+	}
+
+	if _, err := Compile("call time_ms t", "test.ez", Options{Permissions: vm.Permissions{Clock: true}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	program, err := Compile(":loop\ngoto loop", "test.ez", Options{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := program.Run(); !errors.Is(err, vm.ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, vm.ErrTimeout)
+	}
+
+	// The timeout applies to each run, not to the program.
+	if err := program.Run(); !errors.Is(err, vm.ErrTimeout) {
+		t.Fatalf("second run: got %v, want %v", err, vm.ErrTimeout)
+	}
+}
+
+func TestWarningsDoNotStopRun(t *testing.T) {
+	var out strings.Builder
+
+	program, err := Compile("y = 0\nif y then\n  x = 1\nend\ncall shown x", "test.ez", Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings := program.Warnings(); len(warnings) != 1 || warnings[0].Severity != lexer.SeverityWarning {
+		t.Fatalf("got warnings %v, want one", warnings)
+	}
+
+	if err := program.Run(); err == nil || !strings.Contains(err.Error(), "variable does not exist") {
+		t.Fatalf("got %v, want the read to fail at runtime", err)
+	}
+}
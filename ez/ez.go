@@ -1,23 +1,64 @@
 package ez
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/vcokltfre/ez/ez/checker"
 	"github.com/vcokltfre/ez/ez/lexer"
 	"github.com/vcokltfre/ez/ez/parser"
 	"github.com/vcokltfre/ez/ez/vm"
 )
 
-func Run(code, filename string, memory int) error {
+// Load lexes, parses and checks a program against the functions registered
+// on executor. Errors stop it and are all returned as lexer.Diagnostics;
+// warnings do not, and are returned alongside the program.
+func Load(code, filename string, executor *vm.VM) (*parser.Program, lexer.Diagnostics, error) {
+	diags := lexer.Diagnostics{}
+
 	tokens, err := lexer.Lex(code, filename)
 	if err != nil {
-		return err
+		diags.Add(err)
 	}
 
 	program, err := parser.Parse(tokens)
+	if err != nil {
+		diags.Add(err)
+	}
+
+	if !diags.HasErrors() {
+		if err := checker.Check(program, executor); err != nil {
+			diags.Add(err)
+		}
+	}
+
+	diags.Sort()
+
+	if diags.HasErrors() {
+		return nil, nil, diags
+	}
+
+	return program, diags, nil
+}
+
+// Run compiles and runs code once with the process's standard streams, calls
+// nested up to vm.DefaultMaxDepth deep. Use an Engine to set other options.
+func Run(code, filename string, memory int) error {
+	program, err := Compile(code, filename, Options{
+		Memory: memory,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+
+		Permissions: vm.Unrestricted(),
+	})
 	if err != nil {
 		return err
 	}
 
-	executor := vm.New(memory)
+	if warnings := program.Warnings(); len(warnings) > 0 {
+		fmt.Fprintln(os.Stderr, warnings)
+	}
 
-	return executor.Run(program)
+	return program.Run()
 }
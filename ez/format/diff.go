@@ -0,0 +1,129 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lines of unchanged context shown around each change in a diff.
+const diffContext = 3
+
+type edit struct {
+	op   byte
+	line string
+}
+
+// Diff returns a unified diff from old to new, or an empty string if they are
+// the same.
+func Diff(name, old, new string) string {
+	if old == new {
+		return ""
+	}
+
+	edits := diffLines(splitLines(old), splitLines(new))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", name, name)
+
+	oldLine, newLine := 1, 1
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			oldLine++
+			newLine++
+			continue
+		}
+
+		// Grow the hunk while changes are within two contexts of each other.
+		start := max(i-diffContext, 0)
+		end := i
+
+		for gap := 0; end < len(edits) && gap <= 2*diffContext; end++ {
+			if edits[end].op == ' ' {
+				gap++
+			} else {
+				gap = 0
+			}
+		}
+
+		for end > i && edits[end-1].op == ' ' {
+			end--
+		}
+
+		end = min(end+diffContext, len(edits))
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+
+		for _, e := range edits[i:end] {
+			if e.op != '+' {
+				oldLine++
+			}
+			if e.op != '-' {
+				newLine++
+			}
+		}
+
+		i = end
+	}
+
+	return out.String()
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines finds the edits from a to b through their longest common subsequence.
+func diffLines(a, b []string) []edit {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	edits := []edit{}
+	i, j := 0, 0
+
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+
+	return edits
+}
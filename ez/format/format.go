@@ -0,0 +1,245 @@
+package format
+
+import (
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+const indentation = "    "
+
+// level is a block being formatted. Statements after a label are indented one
+// more than the label, up to the next label or the end of the block.
+type level struct {
+	open     int
+	indent   int
+	labelled bool
+}
+
+func (l level) stmtIndent() int {
+	if l.labelled {
+		return l.indent + 1
+	}
+
+	return l.indent
+}
+
+// Format returns code laid out canonically. Formatting works from the tokens
+// so the program means the same afterwards; code that cannot be lexed is
+// returned unchanged along with the errors.
+func Format(code, filename string) (string, error) {
+	tokens, err := lexer.Lex(code, filename)
+	if err != nil {
+		return code, err
+	}
+
+	var out strings.Builder
+
+	levels := []level{{}}
+	blank := false
+	line := []lexer.Token{}
+
+	for _, token := range tokens {
+		if token.Type != lexer.TTEndStmt {
+			line = append(line, token)
+			continue
+		}
+
+		if len(line) == 0 && len(token.Comments) == 0 {
+			blank = out.Len() > 0
+			continue
+		}
+
+		if blank {
+			out.WriteString("\n")
+			blank = false
+		}
+
+		top := &levels[len(levels)-1]
+
+		if len(line) == 0 {
+			out.WriteString(strings.Repeat(indentation, top.stmtIndent()))
+			out.WriteString(comments(token.Comments))
+			out.WriteString("\n")
+			continue
+		}
+		indent := top.stmtIndent()
+		first := line[0].Type
+
+		switch {
+		case first == lexer.TTLabel:
+			indent = top.indent
+			top.labelled = true
+		case first == lexer.TTKeywordEnd && len(levels) > 1:
+			indent = top.open
+			levels = levels[:len(levels)-1]
+		case first == lexer.TTKeywordElse && len(levels) > 1:
+			indent = top.open
+			top.labelled = false
+		case first == lexer.TTKeywordFunc:
+			// Functions are always top level and end the label before them.
+			indent = 0
+			levels[0].labelled = false
+		}
+
+		out.WriteString(strings.Repeat(indentation, indent))
+		out.WriteString(formatLine(line))
+
+		if len(token.Comments) > 0 {
+			out.WriteString(" ")
+			out.WriteString(comments(token.Comments))
+		}
+
+		out.WriteString("\n")
+
+		if opensBlock(line) {
+			levels = append(levels, level{open: indent, indent: indent + 1})
+		}
+
+		line = line[:0]
+	}
+
+	return out.String(), nil
+}
+
+func opensBlock(line []lexer.Token) bool {
+	switch line[0].Type {
+	case lexer.TTKeywordWhile, lexer.TTKeywordFor, lexer.TTKeywordFunc:
+		return true
+	case lexer.TTKeywordIf:
+		// In "if x goto then", then is the name of a label.
+		return line[len(line)-1].Type == lexer.TTKeywordThen && line[len(line)-2].Type != lexer.TTKeywordGoto
+	}
+
+	return false
+}
+
+// comments joins comments found between the same two tokens. Block comments
+// are kept as written, since they may span lines.
+func comments(list []lexer.Comment) string {
+	texts := []string{}
+
+	for _, comment := range list {
+		if comment.Block() {
+			texts = append(texts, comment.Text)
+		} else {
+			texts = append(texts, strings.TrimRight(comment.Text, " \t"))
+		}
+	}
+
+	return strings.Join(texts, " ")
+}
+
+// formatLine joins the tokens of a statement with single spaces, except inside
+// parentheses, before commas, after a unary minus or ~ and between a function name
+// and the parenthesis of its call. Comments inside a statement are set off by
+// spaces on both sides.
+func formatLine(line []lexer.Token) string {
+	var out strings.Builder
+
+	for i, token := range line {
+		if len(token.Comments) > 0 {
+			if i > 0 {
+				out.WriteString(" ")
+			}
+
+			out.WriteString(comments(token.Comments))
+			out.WriteString(" ")
+		} else if i > 0 && space(line[i-1], token, unary(line, i-1)) {
+			out.WriteString(" ")
+		}
+
+		out.WriteString(text(token))
+	}
+
+	return out.String()
+}
+
+// space reports whether a space goes between two tokens. prevUnary is whether
+// prev is a minus sign used as a unary operator.
+func space(prev, next lexer.Token, prevUnary bool) bool {
+	switch {
+	case prev.Type == lexer.TTLParen, next.Type == lexer.TTRParen, next.Type == lexer.TTComma:
+		return false
+	case prev.Type == lexer.TTOpSub && prevUnary, prev.Type == lexer.TTOpBitNot:
+		return false
+	case prev.Type == lexer.TTIdentifier && next.Type == lexer.TTLParen:
+		// Whether the parenthesis is adjacent decides if this is a call.
+		return next.Context.Index != prev.Context.Index+prev.Length
+	}
+
+	return true
+}
+
+// unary reports whether the minus sign line[i] is a unary operator, which the
+// parser decides by what comes before it. In the arguments of a call
+// statement, one with a space before it and none after starts a new argument,
+// so its spacing is kept.
+func unary(line []lexer.Token, i int) bool {
+	if i == 0 {
+		return true
+	}
+
+	// The first argument of a call statement follows the function name.
+	if i == 2 && line[0].Type == lexer.TTKeywordCall {
+		return true
+	}
+
+	switch line[i-1].Type {
+	case lexer.TTIdentifier, lexer.TTLiteralInt, lexer.TTLiteralStr, lexer.TTRParen:
+		return startsArgument(line, i)
+	}
+
+	return true
+}
+
+// startsArgument reports whether the minus sign line[i] starts a new argument
+// of a call statement, as in "call memset 1 -5".
+func startsArgument(line []lexer.Token, i int) bool {
+	if line[0].Type != lexer.TTKeywordCall || i+1 >= len(line) {
+		return false
+	}
+
+	depth := 0
+	for _, token := range line[:i] {
+		switch token.Type {
+		case lexer.TTLParen:
+			depth++
+		case lexer.TTRParen:
+			depth--
+		}
+	}
+
+	return depth == 0 && !line[i-1].Adjacent(line[i]) && line[i].Adjacent(line[i+1])
+}
+
+// text returns the source of a token, with integer literals normalized: no
+// leading zeros in decimal or hexadecimal, and upper case hexadecimal digits.
+// Binary, octal, separators between digits and character literals are kept
+// as written.
+func text(token lexer.Token) string {
+	source := token.Context.Source.Code[token.Context.Index : token.Context.Index+token.Length]
+
+	if token.Type != lexer.TTLiteralInt {
+		return source
+	}
+
+	switch {
+	case strings.HasPrefix(source, "0x"):
+		return "0x" + strings.ToUpper(trimZeros(source[2:]))
+	case strings.HasPrefix(source, "0b"), strings.HasPrefix(source, "0o"), strings.HasPrefix(source, "'"):
+		return source
+	}
+
+	return trimZeros(source)
+}
+
+// trimZeros removes leading zeros from digits, along with separators between
+// them, leaving a single zero if that is all there is.
+func trimZeros(digits string) string {
+	if trimmed := strings.TrimLeft(digits, "0_"); trimmed != "" {
+		return trimmed
+	}
+
+	return "0"
+}
@@ -0,0 +1,118 @@
+package format
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"negative argument", "call memset 1 -5", "call memset 1 -5"},
+		{"subtraction", "call shown x-1", "call shown x - 1"},
+		{"spaced subtraction", "call shown x - 1", "call shown x - 1"},
+		{"negative after group", "call debug (x -1) -2", "call debug (x - 1) -2"},
+		{"subtraction in call", "call debug f(x -1)", "call debug f(x - 1)"},
+		{"unary", "x = - 1", "x = -1"},
+		{"bitwise not", "x = ~ 0", "x = ~0"},
+		{"decimal zeros", "x = 007", "x = 7"},
+		{"zero", "x = 0_0", "x = 0"},
+		{"hex case", "x = 0xff", "x = 0xFF"},
+		{"hex zeros", "x = 0x0ff", "x = 0xFF"},
+		{"hex separators", "x = 0x00_ff_ff", "x = 0xFF_FF"},
+		{"hex zero", "x = 0x000", "x = 0x0"},
+		{"binary", "x = 0b0101", "x = 0b0101"},
+		{"char", "x = '0'", "x = '0'"},
+		{"keyword label", "x = 1\nif x goto then", "x = 1\nif x goto then"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Format(test.in+"\n", "test.ez")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.out+"\n" {
+				t.Fatalf("Format(%q) = %q, want %q", test.in, got, test.out+"\n")
+			}
+
+			again, err := Format(got, "test.ez")
+			if err != nil || again != got {
+				t.Fatalf("formatting is not idempotent: %q, %v", again, err)
+			}
+		})
+	}
+}
+
+const messy = `x=1+2*3
+
+
+
+y   =x<<2
+func f( a,b )
+return a+b
+end
+:loop
+x+=1
+if x<10 goto loop
+while x>0 do
+if x==1 then
+dec x
+else
+inc x
+end
+end
+# comment
+call shown x # trailing
+/* block */
+z = not x  and y
+`
+
+const canonical = `x = 1 + 2 * 3
+
+y = x << 2
+func f(a, b)
+    return a + b
+end
+:loop
+    x += 1
+    if x < 10 goto loop
+    while x > 0 do
+        if x == 1 then
+            dec x
+        else
+            inc x
+        end
+    end
+    # comment
+    call shown x # trailing
+    /* block */
+    z = not x and y
+`
+
+func TestLayout(t *testing.T) {
+	got, err := Format(messy, "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != canonical {
+		t.Fatalf("formatted file differs from the canonical layout:\n%s", Diff("test.ez", canonical, got))
+	}
+
+	if again, err := Format(got, "test.ez"); err != nil || again != got {
+		t.Fatalf("formatting the canonical layout changed it: %v\n%s", err, Diff("test.ez", got, again))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if diff := Diff("a.ez", "x = 1\n", "x = 1\n"); diff != "" {
+		t.Fatalf("diff of equal files = %q, want none", diff)
+	}
+
+	want := "--- a.ez\n+++ a.ez\n@@ -1,2 +1,2 @@\n-x=1\n+x = 1\n y = 2\n"
+	if diff := Diff("a.ez", "x=1\ny = 2\n", "x = 1\ny = 2\n"); diff != want {
+		t.Fatalf("diff:\n%s\nwant:\n%s", diff, want)
+	}
+}
@@ -0,0 +1,157 @@
+package lexer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem found in a program, positioned at the span of
+// source starting at Context and Length bytes long. Errors returned while
+// lexing, parsing, checking or running a program can be inspected as a
+// Diagnostic with errors.As; Step names the stage that produced it. Err, if
+// set, is the error the diagnostic reports, so errors.Is can find it.
+type Diagnostic struct {
+	Severity Severity
+	Step     string
+	Context  TokenContext
+	Length   int
+	Message  string
+	Tip      string
+	Notes    []string
+	Err      error
+}
+
+func (d Diagnostic) Error() string {
+	return d.Format(false)
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// Format renders the diagnostic with a caret under the offending source,
+// using ANSI colors if color is set.
+func (d Diagnostic) Format(color bool) string {
+	paint := func(code, text string) string {
+		if !color {
+			return text
+		}
+
+		return "\033[" + code + "m" + text + "\033[39m"
+	}
+
+	heading := fmt.Sprintf("| An %s occurred during %s:", d.Severity, d.Step)
+	if d.Severity == SeverityWarning {
+		heading = fmt.Sprintf("| A %s was raised during %s:", d.Severity, d.Step)
+	}
+
+	if d.Context.Line == 0 {
+		return heading + "\n|  " + d.Message
+	}
+
+	line := ""
+	if d.Context.Source != nil {
+		line = d.Context.Source.Line(d.Context.Line)
+	}
+
+	padding := strings.Repeat(" ", d.Context.Column-1)
+
+	tipData := ""
+	if d.Tip != "" {
+		tipData = "\n|  " + paint("92", "? "+d.Tip)
+	}
+
+	data := fmt.Sprintf(
+		"%s\n|  File %s, line %d col %d\n|\n|  %s\n|  %s%s%s",
+		heading,
+		d.Context.File(),
+		d.Context.Line,
+		d.Context.Column,
+		paint("96", line),
+		padding,
+		paint("93", "^ "+d.Message),
+		tipData,
+	)
+
+	for _, note := range d.Notes {
+		data += strings.TrimRight("\n|  "+note, " ")
+	}
+
+	return data
+}
+
+// Diagnostics is a list of diagnostics, usable as a single error.
+type Diagnostics []Diagnostic
+
+// Unwrap exposes each diagnostic to errors.Is and errors.As.
+func (d Diagnostics) Unwrap() []error {
+	errs := make([]error, len(d))
+	for i, diag := range d {
+		errs[i] = diag
+	}
+
+	return errs
+}
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d))
+	for i, diag := range d {
+		messages[i] = diag.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Add appends err to the list, flattening any diagnostics it wraps. Other
+// errors are reported as runtime errors with no position.
+func (d *Diagnostics) Add(err error) {
+	var list Diagnostics
+	if errors.As(err, &list) {
+		*d = append(*d, list...)
+		return
+	}
+
+	var diag Diagnostic
+	if errors.As(err, &diag) {
+		*d = append(*d, diag)
+		return
+	}
+
+	// Errors without a position come from the host while a program runs.
+	*d = append(*d, Diagnostic{Severity: SeverityError, Step: "runtime", Message: err.Error(), Err: err})
+}
+
+func (d Diagnostics) HasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sort orders the diagnostics by their position in the source.
+func (d Diagnostics) Sort() {
+	sort.SliceStable(d, func(i, j int) bool {
+		return d[i].Context.Index < d[j].Context.Index
+	})
+}
+
+// Err returns the list as an error, or nil if it is empty.
+func (d Diagnostics) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+
+	return d
+}
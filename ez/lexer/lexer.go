@@ -4,16 +4,18 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const STEP = "lexing"
 
 var (
-	matchDecimalInt = match(`^\d+\b`)
-	matchHexInt     = match(`^0x[0-9a-fA-F]+\b`)
+	matchDecimalInt = match(`^\d[\d_]*\b`)
+	matchHexInt     = match(`^0x[0-9a-fA-F_]+\b`)
+	matchBinaryInt  = match(`^0b[01_]+\b`)
+	matchOctalInt   = match(`^0o[0-7_]+\b`)
 	matchIdentifier = match(`^[a-zA-Z_][a-zA-Z0-9_]*\b`)
 	matchLabel      = match(`^:[a-zA-Z_][a-zA-Z0-9_]*\b`)
-	matchString     = match(`^"[^"]*"`)
 )
 
 func skipWhitespace(code string) int {
@@ -30,29 +32,87 @@ func skipWhitespace(code string) int {
 	return index
 }
 
+func isComment(code string) bool {
+	return code[0] == '#' || code[0] == ';' || strings.HasPrefix(code, "//") || strings.HasPrefix(code, "/*")
+}
+
+// getComment returns the comment at the start of code and how much of the code
+// it covers. Line comments run up to the end of the line.
+func getComment(code string, ctx TokenContext) (Comment, int, error) {
+	if !strings.HasPrefix(code, "/*") {
+		length := strings.IndexByte(code, '\n')
+		if length == -1 {
+			length = len(code)
+		}
+
+		return Comment{Text: strings.TrimSuffix(code[:length], "\r"), Context: ctx}, length, nil
+	}
+
+	depth := 0
+
+	for i := 0; i < len(code)-1; i++ {
+		switch code[i : i+2] {
+		case "/*":
+			depth++
+			i++
+		case "*/":
+			depth--
+			i++
+
+			if depth == 0 {
+				return Comment{Text: code[:i+1], Context: ctx}, i + 1, nil
+			}
+		}
+	}
+
+	return Comment{}, 0, ctx.diagnostic(STEP, 2, "Unterminated block comment", "Block comments are closed with */, once for every /* inside them")
+}
+
+// IntRangeTip explains the range of integer literals.
+const IntRangeTip = "Integers are 64 bits, from -9223372036854775808 to 9223372036854775807"
+
+// getIntLiteral reads a decimal, hexadecimal (0x), binary (0b) or octal (0o)
+// integer. Underscores can separate digits. The token data is always decimal.
+// Up to 2^63 is accepted since that is allowed after a minus sign; the parser
+// checks the rest of the range.
 func getIntLiteral(code string, ctx TokenContext) (*Token, error) {
-	if match := matchHexInt(code); match != nil {
-		val, _ := strconv.ParseInt((*match)[2:], 16, 64)
-		decimal := fmt.Sprintf("%d", val)
+	var match *string
+	base := 10
+
+	for _, m := range []struct {
+		matcher
+		base int
+	}{{matchHexInt, 16}, {matchBinaryInt, 2}, {matchOctalInt, 8}, {matchDecimalInt, 10}} {
+		if match = m.matcher(code); match != nil {
+			base = m.base
+			break
+		}
+	}
 
-		return &Token{
-			Type:    TTLiteralInt,
-			Length:  len(*match),
-			Data:    decimal,
-			Context: ctx,
-		}, nil
+	if match == nil {
+		return nil, ctx.Error(STEP, "Invalid integer literal", "Integer literals are decimal, hexadecimal (0x), binary (0b) or octal (0o)")
 	}
 
-	if match := matchDecimalInt(code); match != nil {
-		return &Token{
-			Type:    TTLiteralInt,
-			Length:  len(*match),
-			Data:    *match,
-			Context: ctx,
-		}, nil
+	digits := *match
+	if base != 10 {
+		digits = digits[2:]
 	}
 
-	return nil, ctx.Error(STEP, "Invalid integer literal", "Integer literals must be in decimal or hexadecimal format")
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return nil, ctx.diagnostic(STEP, len(*match), "Invalid integer literal", "Underscores may only go between digits")
+	}
+
+	val, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 64)
+	if err != nil || val > 1<<63 {
+		return nil, ctx.diagnostic(STEP, len(*match), "Integer literal out of range", IntRangeTip)
+	}
+
+	return &Token{
+		Type:    TTLiteralInt,
+		Length:  len(*match),
+		Data:    strconv.FormatUint(val, 10),
+		Context: ctx,
+	}, nil
 }
 
 func getIdentifier(code string, ctx TokenContext) (*Token, error) {
@@ -105,25 +165,194 @@ func getLabel(code string, ctx TokenContext) (*Token, error) {
 	return nil, ctx.Error(STEP, "Invalid label")
 }
 
+// escapes maps the character after a backslash to what the escape stands for.
+// \x and \u take a code and are handled separately.
+var escapes = map[byte]string{
+	'n':  "\n",
+	't':  "\t",
+	'r':  "\r",
+	'0':  "\x00",
+	'\\': "\\",
+	'"':  "\"",
+	'\'': "'",
+}
+
+const escapeTip = `Valid escapes are \n, \t, \r, \0, \\, \", \', \xNN and \u{N...}`
+
+// at returns the position offset bytes further along the same line.
+func (ctx TokenContext) at(offset int) TokenContext {
+	ctx.Column += offset
+	ctx.Index += offset
+
+	return ctx
+}
+
+// getEscape decodes the escape sequence at the start of code and returns how
+// much of the code it covers.
+func getEscape(code string, ctx TokenContext) (string, int, error) {
+	if len(code) < 2 || code[1] == '\n' {
+		return "", 0, ctx.Error(STEP, "Incomplete escape sequence", escapeTip)
+	}
+
+	if value, ok := escapes[code[1]]; ok {
+		return value, 2, nil
+	}
+
+	switch code[1] {
+	case 'x':
+		if len(code) < 4 || !isHex(code[2:4]) {
+			return "", 0, ctx.diagnostic(STEP, min(len(code), 4), "Invalid escape sequence", "\\x must be followed by two hexadecimal digits")
+		}
+
+		value, _ := strconv.ParseUint(code[2:4], 16, 8)
+
+		return string([]byte{byte(value)}), 4, nil
+	case 'u':
+		end := strings.IndexAny(code, "}\n")
+		if !strings.HasPrefix(code[2:], "{") || end == -1 || code[end] != '}' || end == 3 || end > 9 || !isHex(code[3:end]) {
+			return "", 0, ctx.diagnostic(STEP, 2, "Invalid escape sequence", "\\u must be followed by one to six hexadecimal digits in braces, like \\u{1F600}")
+		}
+
+		value, _ := strconv.ParseUint(code[3:end], 16, 32)
+		if !utf8.ValidRune(rune(value)) {
+			return "", 0, ctx.diagnostic(STEP, end+1, "Invalid escape sequence", fmt.Sprintf("U+%X is not a valid code point", value))
+		}
+
+		return string(rune(value)), end + 1, nil
+	}
+
+	_, size := utf8.DecodeRuneInString(code[1:])
+
+	return "", 0, ctx.diagnostic(STEP, 1+size, fmt.Sprintf("Unknown escape sequence: %s", code[:1+size]), escapeTip)
+}
+
+func isHex(code string) bool {
+	for i := 0; i < len(code); i++ {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(code[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getQuoted reads a literal that starts and ends with quote and cannot span
+// lines, decoding its escapes. It returns the value and the length of the
+// literal including the quotes.
+func getQuoted(code string, quote byte, ctx TokenContext) (string, int, error) {
+	var value strings.Builder
+
+	for i := 1; i < len(code) && code[i] != '\n'; {
+		switch code[i] {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\\':
+			decoded, length, err := getEscape(code[i:], ctx.at(i))
+			if err != nil {
+				return "", 0, err
+			}
+
+			value.WriteString(decoded)
+			i += length
+		default:
+			value.WriteByte(code[i])
+			i++
+		}
+	}
+
+	return "", 0, nil
+}
+
 func getString(code string, ctx TokenContext) (*Token, error) {
-	if match := matchString(code); match != nil {
-		return &Token{
-			Type:    TTLiteralStr,
-			Length:  len(*match),
-			Data:    (*match)[1 : len(*match)-1],
-			Context: ctx,
-		}, nil
+	value, length, err := getQuoted(code, '"', ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return nil, ctx.Error(STEP, "Unterminated string literal", "Strings end on the line they start; use \\n for a line break, or a `raw string`")
 	}
 
-	return nil, ctx.Error(STEP, "Invalid string literal")
+	return &Token{
+		Type:    TTLiteralStr,
+		Length:  length,
+		Data:    value,
+		Context: ctx,
+	}, nil
 }
 
+// getRawString reads a string between backticks, which has no escapes and can
+// span lines. Carriage returns are left out so line endings do not matter.
+func getRawString(code string, ctx TokenContext) (*Token, error) {
+	end := strings.IndexByte(code[1:], '`')
+	if end == -1 {
+		return nil, ctx.Error(STEP, "Unterminated raw string literal")
+	}
+
+	return &Token{
+		Type:    TTLiteralStr,
+		Length:  end + 2,
+		Data:    strings.ReplaceAll(code[1:end+1], "\r", ""),
+		Context: ctx,
+	}, nil
+}
+
+// getChar reads a character literal, which is the integer code point of the
+// character. A \x escape stands for the byte itself.
+func getChar(code string, ctx TokenContext) (*Token, error) {
+	value, length, err := getQuoted(code, '\'', ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return nil, ctx.Error(STEP, "Unterminated character literal")
+	}
+
+	point := rune(-1)
+
+	if len(value) == 1 {
+		point = rune(value[0])
+	} else if r, size := utf8.DecodeRuneInString(value); r != utf8.RuneError && size == len(value) {
+		point = r
+	}
+
+	if point == -1 {
+		return nil, ctx.diagnostic(STEP, length, "Invalid character literal", "Character literals hold exactly one character")
+	}
+
+	return &Token{
+		Type:    TTLiteralInt,
+		Length:  length,
+		Data:    fmt.Sprintf("%d", point),
+		Context: ctx,
+	}, nil
+}
+
+// advance returns the position after text, which may span lines.
+func advance(text string, line, column int) (int, int) {
+	if lines := strings.Count(text, "\n"); lines > 0 {
+		return line + lines, len(text) - strings.LastIndexByte(text, '\n')
+	}
+
+	return line, column + len(text)
+}
+
+// Lex splits code into tokens. Lines that cannot be lexed are left out and
+// reported together as Diagnostics, alongside the tokens of every other line.
 func Lex(code, filename string) ([]Token, error) {
+	source := NewSourceFile(filename, code)
 	index := 0
 	line := 1
 	column := 1
 
 	tokens := []Token{}
+	comments := []Comment{}
+	lineStart := 0
+	diags := Diagnostics{}
+
+	// The start of a comment spanning lines that the statement has to end at.
+	var end *TokenContext
 
 	for index < len(code) {
 		current := code[index]
@@ -132,17 +361,21 @@ func Lex(code, filename string) ([]Token, error) {
 			Line:   line,
 			Column: column,
 			Index:  index,
-			File:   filename,
+			Source: source,
 		}
 
 		if current == '\n' {
+			end = nil
 			tokens = append(tokens, Token{
-				Type:    TTEndStmt,
-				Context: context,
+				Type:     TTEndStmt,
+				Context:  context,
+				Comments: comments,
 			})
+			comments = nil
 			index++
 			line++
 			column = 1
+			lineStart = len(tokens)
 			continue
 		}
 
@@ -153,67 +386,92 @@ func Lex(code, filename string) ([]Token, error) {
 			continue
 		}
 
-		if '0' <= current && current <= '9' {
-			token, err := getIntLiteral(code[index:], context)
+		if isComment(code[index:]) {
+			comment, length, err := getComment(code[index:], context)
 			if err != nil {
-				return nil, err
+				// Nothing after an unterminated comment is code.
+				diags.Add(err)
+				tokens = tokens[:lineStart]
+				comments = nil
+				index = len(code)
+				continue
 			}
 
-			tokens = append(tokens, *token)
-			index += token.Length
-			column += token.Length
-			continue
-		}
+			comments = append(comments, comment)
+			line, column = advance(code[index:index+length], line, column)
+			index += length
 
-		if 'a' <= current && current <= 'z' || 'A' <= current && current <= 'Z' || current == '_' {
-			token, err := getIdentifier(code[index:], context)
-			if err != nil {
-				return nil, err
+			// A comment spanning lines ends the statement, like the newline in it
+			// would have, once more code follows on the line it ends on.
+			if strings.Contains(comment.Text, "\n") && end == nil {
+				end = &context
 			}
 
-			tokens = append(tokens, *token)
-			index += token.Length
-			column += token.Length
 			continue
 		}
 
-		if isOperatorCharacter(string(current)) {
-			token, err := getOperator(code[index:], context)
-			if err != nil {
-				return nil, err
-			}
+		if end != nil {
+			tokens = append(tokens, Token{
+				Type:     TTEndStmt,
+				Context:  *end,
+				Comments: comments,
+			})
+			comments = nil
+			end = nil
+			lineStart = len(tokens)
+		}
 
-			tokens = append(tokens, *token)
-			index += token.Length
-			column += token.Length
-			continue
+		var getToken func(string, TokenContext) (*Token, error)
+
+		switch {
+		case '0' <= current && current <= '9':
+			getToken = getIntLiteral
+		case 'a' <= current && current <= 'z' || 'A' <= current && current <= 'Z' || current == '_':
+			getToken = getIdentifier
+		case isOperatorCharacter(string(current)):
+			getToken = getOperator
+		case current == ':':
+			getToken = getLabel
+		case current == '"':
+			getToken = getString
+		case current == '`':
+			getToken = getRawString
+		case current == '\'':
+			getToken = getChar
 		}
 
-		if current == ':' {
-			token, err := getLabel(code[index:], context)
-			if err != nil {
-				return nil, err
-			}
+		var token *Token
+		var err error
 
-			tokens = append(tokens, *token)
-			index += token.Length
-			column += token.Length
-			continue
+		if getToken != nil {
+			token, err = getToken(code[index:], context)
+		} else {
+			err = context.Error(STEP, fmt.Sprintf("Unexpected character: %s", string(current)))
 		}
 
-		if current == '"' {
-			token, err := getString(code[index:], context)
-			if err != nil {
-				return nil, err
+		if err != nil {
+			// Drop the rest of the line so the parser does not see half a statement.
+			diags.Add(err)
+			tokens = tokens[:lineStart]
+			comments = nil
+
+			// An unterminated raw string takes the rest of the code with it.
+			skip := strings.IndexByte(code[index:], '\n')
+			if skip == -1 || current == '`' {
+				skip = len(code) - index
 			}
 
-			tokens = append(tokens, *token)
-			index += token.Length
-			column += token.Length
+			index += skip
+			column += skip
 			continue
 		}
 
-		return nil, context.Error(STEP, fmt.Sprintf("Unexpected character: %s", string(current)))
+		token.Comments = comments
+		comments = nil
+
+		tokens = append(tokens, *token)
+		line, column = advance(code[index:index+token.Length], line, column)
+		index += token.Length
 	}
 
 	tokens = append(tokens, Token{
@@ -222,9 +480,10 @@ func Lex(code, filename string) ([]Token, error) {
 			Line:   line,
 			Column: column,
 			Index:  index,
-			File:   filename,
+			Source: source,
 		},
+		Comments: comments,
 	})
 
-	return tokens, nil
+	return tokens, diags.Err()
 }
@@ -0,0 +1,165 @@
+package lexer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// statements splits tokens at each end of statement, leaving out empty ones.
+func statements(tokens []Token) []string {
+	stmts := []string{}
+	current := []string{}
+
+	for _, token := range tokens {
+		if token.Type != TTEndStmt {
+			current = append(current, token.Data)
+			continue
+		}
+
+		if len(current) > 0 {
+			stmts = append(stmts, strings.Join(current, " "))
+		}
+
+		current = nil
+	}
+
+	return stmts
+}
+
+func TestBlockCommentsEndStatements(t *testing.T) {
+	tests := []struct {
+		code  string
+		stmts []string
+	}{
+		{"a = 1 /* x */ b", []string{"a = 1 b"}},
+		{"a = 1 /* x\n */ b = 2", []string{"a = 1", "b = 2"}},
+		{"a = 1 /* x\n */\nb = 2", []string{"a = 1", "b = 2"}},
+		{"/* x\n */ b = 2", []string{"b = 2"}},
+		{"a = 1 /* x /* y\n */ */ b = 2", []string{"a = 1", "b = 2"}},
+		{"a = 1 # x\nb = 2", []string{"a = 1", "b = 2"}},
+		{"a = 1 /*\n*/ /*x*/ b = 2", []string{"a = 1", "b = 2"}},
+		{"a = 1 /*x*/ /*\n*/ b = 2", []string{"a = 1", "b = 2"}},
+		{"a = 1 /*\n*/ /*x*/\nb = 2", []string{"a = 1", "b = 2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			tokens, err := Lex(test.code, "test.ez")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := statements(tokens)
+			if strings.Join(got, "|") != strings.Join(test.stmts, "|") {
+				t.Fatalf("got statements %q, want %q", got, test.stmts)
+			}
+		})
+	}
+}
+
+func TestCommentsAttachToNextToken(t *testing.T) {
+	tokens, err := Lex("a = 1 /* x\n */ b = 2", "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		if len(token.Comments) > 0 {
+			if token.Type != TTEndStmt || token.Comments[0].Text != "/* x\n */" {
+				t.Fatalf("comment attached to %v: %q", token.Type, token.Comments[0].Text)
+			}
+
+			return
+		}
+	}
+
+	t.Fatal("comment was dropped")
+}
+
+func TestLiterals(t *testing.T) {
+	tests := []struct {
+		code string
+		typ  TokenType
+		data string
+	}{
+		{`"a\nb"`, TTLiteralStr, "a\nb"},
+		{`"\t\r\0\\\"\'"`, TTLiteralStr, "\t\r\x00\\\"'"},
+		{`"\x41\x7e"`, TTLiteralStr, "A~"},
+		{`"\xff"`, TTLiteralStr, "\xff"},
+		{`"\u{1F600}"`, TTLiteralStr, "😀"},
+		{`""`, TTLiteralStr, ""},
+		{"`a\\n\nb`", TTLiteralStr, "a\\n\nb"},
+		{"`a\r\nb`", TTLiteralStr, "a\nb"},
+		{"'A'", TTLiteralInt, "65"},
+		{`'\n'`, TTLiteralInt, "10"},
+		{`'\''`, TTLiteralInt, "39"},
+		{`'\xff'`, TTLiteralInt, "255"},
+		{"'é'", TTLiteralInt, "233"},
+		{`'\u{1F600}'`, TTLiteralInt, "128512"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			tokens, err := Lex(test.code, "test.ez")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tokens) != 2 {
+				t.Fatalf("got %d tokens, want the literal and the end of statement", len(tokens))
+			}
+
+			token := tokens[0]
+			if token.Type != test.typ || token.Data != test.data || token.Length != len(test.code) {
+				t.Fatalf("got %s %q of length %d, want %s %q of length %d", token.Type, token.Data, token.Length, test.typ, test.data, len(test.code))
+			}
+		})
+	}
+}
+
+func TestLiteralErrors(t *testing.T) {
+	tests := []struct {
+		code    string
+		message string
+	}{
+		{`"abc`, "Unterminated string literal"},
+		{"\"abc\nx = 1", "Unterminated string literal"},
+		{`"\q"`, `Unknown escape sequence: \q`},
+		{`"\`, "Incomplete escape sequence"},
+		{"\"\\\nx = 1", "Incomplete escape sequence"},
+		{`"\x4"`, "Invalid escape sequence"},
+		{`"\xzz"`, "Invalid escape sequence"},
+		{`"\u41"`, "Invalid escape sequence"},
+		{`"\u{}"`, "Invalid escape sequence"},
+		{`"\u{D800}"`, "Invalid escape sequence"},
+		{"`abc", "Unterminated raw string literal"},
+		{"'a", "Unterminated character literal"},
+		{"''", "Invalid character literal"},
+		{"'ab'", "Invalid character literal"},
+		{`'\q'`, `Unknown escape sequence: \q`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			_, err := Lex(test.code, "test.ez")
+
+			var diags Diagnostics
+			if !errors.As(err, &diags) || len(diags) != 1 || diags[0].Message != test.message {
+				t.Fatalf("got %v, want %q", err, test.message)
+			}
+		})
+	}
+}
+
+// A bad literal only drops its own line.
+func TestLiteralErrorKeepsOtherLines(t *testing.T) {
+	tokens, err := Lex("a = \"\\q\"\nb = 'x'", "test.ez")
+	if err == nil {
+		t.Fatal("lexed an unknown escape")
+	}
+
+	if got := statements(tokens); strings.Join(got, "|") != "b = 120" {
+		t.Fatalf("got statements %q, want %q", got, []string{"b = 120"})
+	}
+}
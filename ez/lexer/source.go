@@ -0,0 +1,30 @@
+package lexer
+
+import "strings"
+
+// SourceFile is the text of a program as it was given to the lexer. Tokens
+// point back to it so diagnostics can show the offending line without going
+// back to the filesystem, which also works for code that never lived in a file.
+type SourceFile struct {
+	Name string
+	Code string
+
+	lines []string
+}
+
+func NewSourceFile(name, code string) *SourceFile {
+	return &SourceFile{
+		Name:  name,
+		Code:  code,
+		lines: strings.Split(code, "\n"),
+	}
+}
+
+// Line returns the text of a line, counting from 1, without its line ending.
+func (s *SourceFile) Line(line int) string {
+	if line < 1 || line > len(s.lines) {
+		return ""
+	}
+
+	return strings.TrimSuffix(s.lines[line-1], "\r")
+}
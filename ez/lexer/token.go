@@ -1,12 +1,6 @@
 package lexer
 
-import (
-	"bytes"
-	"errors"
-	"fmt"
-	"os"
-	"strings"
-)
+import "strings"
 
 type TokenType string
 
@@ -17,6 +11,21 @@ const (
 	TTKeywordShowchar TokenType = "showchar"
 	TTKeywordInput    TokenType = "input"
 	TTKeywordCall     TokenType = "call"
+	TTKeywordThen     TokenType = "then"
+	TTKeywordElse     TokenType = "else"
+	TTKeywordEnd      TokenType = "end"
+	TTKeywordWhile    TokenType = "while"
+	TTKeywordDo       TokenType = "do"
+	TTKeywordFor      TokenType = "for"
+	TTKeywordTo       TokenType = "to"
+	TTKeywordStep     TokenType = "step"
+	TTKeywordBreak    TokenType = "break"
+	TTKeywordContinue TokenType = "continue"
+	TTKeywordFunc     TokenType = "func"
+	TTKeywordReturn   TokenType = "return"
+	TTKeywordGosub    TokenType = "gosub"
+	TTKeywordInc      TokenType = "inc"
+	TTKeywordDec      TokenType = "dec"
 
 	TTIdentifier TokenType = "identifier"
 	TTLiteralInt TokenType = "literal_int"
@@ -24,6 +33,18 @@ const (
 
 	TTOpAssign TokenType = "op_assign"
 
+	TTOpAddAssign  TokenType = "op_add_assign"
+	TTOpSubAssign  TokenType = "op_sub_assign"
+	TTOpMulAssign  TokenType = "op_mul_assign"
+	TTOpDivAssign  TokenType = "op_div_assign"
+	TTOpModAssign  TokenType = "op_mod_assign"
+	TTOpPowAssign  TokenType = "op_pow_assign"
+	TTOpAndAssign  TokenType = "op_bit_and_assign"
+	TTOpOrAssign   TokenType = "op_bit_or_assign"
+	TTOpShlAssign  TokenType = "op_shl_assign"
+	TTOpShrAssign  TokenType = "op_shr_assign"
+	TTOpUshrAssign TokenType = "op_ushr_assign"
+
 	TTOpLt  TokenType = "op_lt"
 	TTOpGt  TokenType = "op_gt"
 	TTOpLte TokenType = "op_lte"
@@ -38,15 +59,50 @@ const (
 	TTOpMod TokenType = "op_mod"
 	TTOpPow TokenType = "op_pow"
 
+	TTOpBitAnd TokenType = "op_bit_and"
+	TTOpBitOr  TokenType = "op_bit_or"
+	TTOpXor    TokenType = "op_xor"
+	TTOpBitNot TokenType = "op_bit_not"
+	TTOpShl    TokenType = "op_shl"
+	TTOpShr    TokenType = "op_shr"
+	TTOpUshr   TokenType = "op_ushr"
+
+	TTOpAnd TokenType = "op_and"
+	TTOpOr  TokenType = "op_or"
+	TTOpNot TokenType = "op_not"
+
+	TTLParen TokenType = "lparen"
+	TTRParen TokenType = "rparen"
+	TTComma  TokenType = "comma"
+
 	TTLabel TokenType = "label"
 
 	TTEndStmt TokenType = "end_stmt"
 )
 
 var Keywords = map[string]TokenType{
-	"if":   TTKeywordIf,
-	"goto": TTKeywordGoto,
-	"call": TTKeywordCall,
+	"if":       TTKeywordIf,
+	"goto":     TTKeywordGoto,
+	"call":     TTKeywordCall,
+	"then":     TTKeywordThen,
+	"else":     TTKeywordElse,
+	"end":      TTKeywordEnd,
+	"while":    TTKeywordWhile,
+	"do":       TTKeywordDo,
+	"for":      TTKeywordFor,
+	"to":       TTKeywordTo,
+	"step":     TTKeywordStep,
+	"break":    TTKeywordBreak,
+	"continue": TTKeywordContinue,
+	"func":     TTKeywordFunc,
+	"return":   TTKeywordReturn,
+	"gosub":    TTKeywordGosub,
+	"inc":      TTKeywordInc,
+	"dec":      TTKeywordDec,
+	"xor":      TTOpXor,
+	"and":      TTOpAnd,
+	"or":       TTOpOr,
+	"not":      TTOpNot,
 }
 
 func IsKeyword(word string) bool {
@@ -55,25 +111,48 @@ func IsKeyword(word string) bool {
 }
 
 var Operators = map[string]TokenType{
-	"=":  TTOpAssign,
-	"<":  TTOpLt,
-	">":  TTOpGt,
-	"<=": TTOpLte,
-	">=": TTOpGte,
-	"==": TTOpEq,
-	"!=": TTOpNeq,
-	"+":  TTOpAdd,
-	"-":  TTOpSub,
-	"*":  TTOpMul,
-	"/":  TTOpDiv,
-	"%":  TTOpMod,
-	"^":  TTOpPow,
-}
-
-var orderedOperators = []string{"<=", ">=", "==", "!=", "<", ">", "=", "+", "-", "*", "/", "%", "^"}
+	"=":    TTOpAssign,
+	"+=":   TTOpAddAssign,
+	"-=":   TTOpSubAssign,
+	"*=":   TTOpMulAssign,
+	"/=":   TTOpDivAssign,
+	"%=":   TTOpModAssign,
+	"^=":   TTOpPowAssign,
+	"&=":   TTOpAndAssign,
+	"|=":   TTOpOrAssign,
+	"<<=":  TTOpShlAssign,
+	">>=":  TTOpShrAssign,
+	">>>=": TTOpUshrAssign,
+	"<":    TTOpLt,
+	">":    TTOpGt,
+	"<=":   TTOpLte,
+	">=":   TTOpGte,
+	"==":   TTOpEq,
+	"!=":   TTOpNeq,
+	"+":    TTOpAdd,
+	"-":    TTOpSub,
+	"*":    TTOpMul,
+	"/":    TTOpDiv,
+	"%":    TTOpMod,
+	"^":    TTOpPow,
+	"&":    TTOpBitAnd,
+	"|":    TTOpBitOr,
+	"~":    TTOpBitNot,
+	"<<":   TTOpShl,
+	">>":   TTOpShr,
+	">>>":  TTOpUshr,
+	"(":    TTLParen,
+	")":    TTRParen,
+	",":    TTComma,
+}
+
+var orderedOperators = []string{
+	">>>=", ">>>", "<<=", ">>=", "+=", "-=", "*=", "/=", "%=", "^=", "&=", "|=",
+	"<<", ">>", "<=", ">=", "==", "!=", "<", ">", "=", "+", "-", "*", "/", "%", "^", "&", "|", "~", "(", ")", ",",
+}
 
 var operatorCharacters = []string{
-	"=", "<", ">", "!", "+", "-", "*", "/", "%", "^",
+	"=", "<", ">", "!", "+", "-", "*", "/", "%", "^", "&", "|", "~", "(", ")", ",",
 }
 
 func isOperatorCharacter(char string) bool {
@@ -90,38 +169,43 @@ type TokenContext struct {
 	Line   int
 	Column int
 	Index  int
-	File   string
+	Source *SourceFile
 }
 
-func (ctx *TokenContext) Error(step, message string, tip ...string) error {
-	fd, err := os.ReadFile(ctx.File)
-	if err != nil {
-		panic(err)
+func (ctx TokenContext) File() string {
+	if ctx.Source == nil {
+		return ""
 	}
 
-	lines := bytes.Split(fd, []byte("\n"))
-	line := lines[ctx.Line-1]
+	return ctx.Source.Name
+}
+
+func (ctx TokenContext) Error(step, message string, tip ...string) error {
+	return ctx.diagnostic(step, 1, message, tip...)
+}
 
-	padding := strings.Repeat(" ", ctx.Column-1)
+// Wrap returns a diagnostic reporting err at the position.
+func (ctx TokenContext) Wrap(step string, err error, tip ...string) error {
+	diag := ctx.diagnostic(step, 1, err.Error(), tip...)
+	diag.Err = err
 
-	tipData := ""
-	if len(tip) > 0 {
-		tipData = fmt.Sprintf("\n|  \033[92m? %s", tip[0])
+	return diag
+}
+
+func (ctx TokenContext) diagnostic(step string, length int, message string, tip ...string) Diagnostic {
+	diag := Diagnostic{
+		Severity: SeverityError,
+		Step:     step,
+		Context:  ctx,
+		Length:   length,
+		Message:  message,
 	}
 
-	data := fmt.Sprintf(
-		"| An error occurred during %s:\n|  File %s, line %d col %d\n|\n|  \033[96m%s\033[39m\n|  %s\033[93m^ %s\033[39m%s",
-		step,
-		ctx.File,
-		ctx.Line,
-		ctx.Column,
-		string(line),
-		padding,
-		message,
-		tipData,
-	)
+	if len(tip) > 0 {
+		diag.Tip = tip[0]
+	}
 
-	return errors.New(data)
+	return diag
 }
 
 type Token struct {
@@ -129,4 +213,40 @@ type Token struct {
 	Length  int
 	Data    string
 	Context TokenContext
+
+	// Comments are the comments between the previous token and this one.
+	Comments []Comment
+}
+
+// Comment is a line comment, starting with #, // or ;, or a block comment
+// between /* and */, which can be nested and span lines. Comments are not
+// tokens; they are kept on the token after them so tools can reproduce them.
+type Comment struct {
+	Text    string
+	Context TokenContext
+}
+
+// Block reports whether the comment is a block comment.
+func (c Comment) Block() bool {
+	return strings.HasPrefix(c.Text, "/*")
+}
+
+// Error returns a diagnostic spanning the whole token.
+func (t Token) Error(step, message string, tip ...string) error {
+	return t.Context.diagnostic(step, max(t.Length, 1), message, tip...)
+}
+
+// Warning returns a warning spanning the whole token. Unlike an error, it
+// does not stop the program from running.
+func (t Token) Warning(step, message string, tip ...string) error {
+	diag := t.Context.diagnostic(step, max(t.Length, 1), message, tip...)
+	diag.Severity = SeverityWarning
+
+	return diag
+}
+
+// Adjacent reports whether next starts right where t ends, with no space or
+// comment between them.
+func (t Token) Adjacent(next Token) bool {
+	return next.Context.Index == t.Context.Index+t.Length
 }
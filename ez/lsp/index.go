@@ -0,0 +1,352 @@
+package lsp
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	"github.com/vcokltfre/ez/ez/checker"
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+// scope is the top level of a document or the body of a function. Labels, and
+// variables local to a function, are resolved within their scope. Generated
+// labels and variables are left out since they have no place in the source.
+type scope struct {
+	fn          *parser.Func
+	first, last int
+
+	labels map[string]lexer.Token
+	jumps  []lexer.Token
+	vars   []lexer.Token
+	locals map[string]bool
+	seen   map[int]bool
+}
+
+func newScope(fn *parser.Func) *scope {
+	return &scope{
+		fn:     fn,
+		labels: map[string]lexer.Token{},
+		locals: map[string]bool{},
+		seen:   map[int]bool{},
+	}
+}
+
+func generated(name string, token lexer.Token) bool {
+	return strings.HasPrefix(name, "__") || token.Type != lexer.TTIdentifier
+}
+
+func (s *scope) addVar(name string, token lexer.Token) {
+	// Lowered loops reuse the counter's token for several statements.
+	if generated(name, token) || s.seen[token.Context.Index] {
+		return
+	}
+
+	s.seen[token.Context.Index] = true
+	s.vars = append(s.vars, token)
+}
+
+func (s *scope) addJump(name string, token lexer.Token) {
+	if !generated(name, token) {
+		s.jumps = append(s.jumps, token)
+	}
+}
+
+func (s *scope) addExpr(expr parser.Expr) {
+	switch expr := expr.(type) {
+	case parser.Value:
+		if expr.Type == parser.ValueTypeVar {
+			s.addVar(expr.Value, expr.Token)
+		}
+	case parser.UnaryExpr:
+		s.addExpr(expr.Operand)
+	case parser.BinaryExpr:
+		s.addExpr(expr.Lhs)
+		s.addExpr(expr.Rhs)
+	case parser.CallExpr:
+		for _, arg := range expr.Args {
+			s.addExpr(arg)
+		}
+	}
+}
+
+func (s *scope) addStmts(stmts []parser.Stmt) {
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case parser.VarDecl:
+			s.addVar(stmt.Name, stmt.Token)
+			s.addExpr(stmt.Value)
+		case parser.If:
+			s.addExpr(stmt.Cond)
+			s.addJump(stmt.Goto.Name, stmt.Goto.Token)
+		case parser.Label:
+			if stmt.Token.Type == lexer.TTLabel {
+				s.labels[stmt.Name] = stmt.Token
+			}
+		case parser.Goto:
+			s.addJump(stmt.Name, stmt.Token)
+		case parser.Gosub:
+			s.addJump(stmt.Name, stmt.Token)
+		case parser.Call:
+			for _, arg := range stmt.Args {
+				s.addExpr(arg)
+			}
+		case parser.Return:
+			s.addExpr(stmt.Value)
+		}
+	}
+}
+
+// contains reports whether a variable or jump token belongs to the scope.
+func (s *scope) contains(tokens []lexer.Token, token lexer.Token) bool {
+	for _, t := range tokens {
+		if t.Context.Index == token.Context.Index {
+			return true
+		}
+	}
+
+	return false
+}
+
+// document is the analysis of one open file, redone on every change.
+type document struct {
+	uri    string
+	text   string
+	tokens []lexer.Token
+	diags  lexer.Diagnostics
+	scopes []*scope
+	funcs  map[string]parser.Func
+}
+
+func analyze(uri, text string, executor *vm.VM) *document {
+	doc := &document{uri: uri, text: text, funcs: map[string]parser.Func{}}
+
+	tokens, err := lexer.Lex(text, strings.TrimPrefix(uri, "file://"))
+	if err != nil {
+		doc.diags.Add(err)
+	}
+	doc.tokens = tokens
+
+	program, err := parser.Parse(tokens)
+	if err != nil {
+		doc.diags.Add(err)
+	}
+
+	if !doc.diags.HasErrors() {
+		if err := checker.Check(program, executor); err != nil {
+			doc.diags.Add(err)
+		}
+	}
+
+	top := newScope(nil)
+	top.addStmts(program.Stmts)
+	doc.scopes = append(doc.scopes, top)
+
+	// A variable is local to a function exactly when the compiler gives it a
+	// slot there; every other variable a function uses is global.
+	locals := map[string][]string{}
+	for _, fn := range vm.Compile(program, executor.Funcs).Funcs {
+		locals[fn.Name] = fn.Locals
+	}
+
+	for _, stmt := range program.Stmts {
+		decl, ok := stmt.(parser.Func)
+		if !ok {
+			continue
+		}
+
+		doc.funcs[decl.Name] = decl
+
+		fn := newScope(&decl)
+		fn.first = decl.Token.Context.Line
+		fn.last = decl.Body[len(decl.Body)-1].(parser.Return).Token.Context.Line
+
+		for _, param := range doc.params(decl) {
+			fn.addVar(param.Data, param)
+		}
+
+		fn.addStmts(decl.Body)
+
+		for _, name := range locals[decl.Name] {
+			fn.locals[name] = true
+		}
+
+		doc.scopes = append(doc.scopes, fn)
+	}
+
+	return doc
+}
+
+// params returns the parameter tokens of a function, which follow its name.
+func (d *document) params(decl parser.Func) []lexer.Token {
+	params := []lexer.Token{}
+
+	for i, token := range d.tokens {
+		if token.Context.Index != decl.Token.Context.Index {
+			continue
+		}
+
+		for _, token := range d.tokens[i+1:] {
+			if token.Type == lexer.TTRParen || token.Type == lexer.TTEndStmt {
+				break
+			}
+
+			if token.Type == lexer.TTIdentifier {
+				params = append(params, token)
+			}
+		}
+	}
+
+	return params
+}
+
+// The protocol counts characters in UTF-16 code units, while the lexer counts
+// bytes.
+
+// position returns the protocol position of a byte offset in the document.
+func (d *document) position(index int) position {
+	index = min(max(index, 0), len(d.text))
+	start := strings.LastIndexByte(d.text[:index], '\n') + 1
+
+	units := 0
+	for _, r := range d.text[start:index] {
+		units += utf16.RuneLen(r)
+	}
+
+	return position{Line: strings.Count(d.text[:start], "\n"), Character: units}
+}
+
+// offset returns the byte offset of a protocol position in the document.
+func (d *document) offset(pos position) int {
+	start := 0
+	for range pos.Line {
+		next := strings.IndexByte(d.text[start:], '\n')
+		if next == -1 {
+			return len(d.text)
+		}
+
+		start += next + 1
+	}
+
+	units := 0
+	for i, r := range d.text[start:] {
+		if units >= pos.Character || r == '\n' {
+			return start + i
+		}
+
+		units += utf16.RuneLen(r)
+	}
+
+	return len(d.text)
+}
+
+// span returns the range of length bytes starting at a token context.
+func (d *document) span(ctx lexer.TokenContext, length int) textRange {
+	return textRange{Start: d.position(ctx.Index), End: d.position(ctx.Index + length)}
+}
+
+// tokenAt returns the token under a position, including the position just
+// after its end.
+func (d *document) tokenAt(pos position) (lexer.Token, bool) {
+	index := d.offset(pos)
+
+	for _, token := range d.tokens {
+		if token.Type == lexer.TTEndStmt || token.Context.Line != pos.Line+1 {
+			continue
+		}
+
+		if index >= token.Context.Index && index <= token.Context.Index+token.Length {
+			return token, true
+		}
+	}
+
+	return lexer.Token{}, false
+}
+
+// previous returns the token before the one at a position on the same line.
+func (d *document) previous(pos position) (lexer.Token, bool) {
+	index := d.offset(pos)
+
+	var prev lexer.Token
+	found := false
+
+	for _, token := range d.tokens {
+		if token.Type == lexer.TTEndStmt || token.Context.Line != pos.Line+1 {
+			continue
+		}
+
+		if token.Context.Index+token.Length >= index {
+			break
+		}
+
+		prev, found = token, true
+	}
+
+	return prev, found
+}
+
+func (d *document) scopeAt(line int) *scope {
+	for _, s := range d.scopes[1:] {
+		if line >= s.first && line <= s.last {
+			return s
+		}
+	}
+
+	return d.scopes[0]
+}
+
+// labelRefs returns the jumps to a label, and the label itself if it is defined.
+func (d *document) labelRefs(s *scope, name string, declaration bool) []lexer.Token {
+	refs := []lexer.Token{}
+
+	if label, ok := s.labels[name]; ok && declaration {
+		refs = append(refs, label)
+	}
+
+	for _, jump := range s.jumps {
+		if jump.Data == name {
+			refs = append(refs, jump)
+		}
+	}
+
+	return refs
+}
+
+// varRefs returns every use of a variable, across all scopes for globals.
+func (d *document) varRefs(s *scope, name string) []lexer.Token {
+	refs := []lexer.Token{}
+
+	for _, other := range d.scopes {
+		if s.locals[name] && other != s || !s.locals[name] && other.locals[name] {
+			continue
+		}
+
+		for _, token := range other.vars {
+			if token.Data == name {
+				refs = append(refs, token)
+			}
+		}
+	}
+
+	return refs
+}
+
+// visibleVars returns the names of the variables usable in a scope.
+func (d *document) visibleVars(s *scope) []string {
+	names := map[string]bool{}
+
+	for name := range s.locals {
+		names[name] = true
+	}
+
+	for _, other := range d.scopes {
+		for _, token := range other.vars {
+			if !other.locals[token.Data] {
+				names[token.Data] = true
+			}
+		}
+	}
+
+	return sortedKeys(names)
+}
@@ -0,0 +1,422 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+// Descriptions of the builtins ez registers, shown on hover below the usage
+// generated from their signatures.
+var builtinDocs = map[string]string{
+	"showc":                 "Prints the character with the given code.",
+	"shown":                 "Prints a number.",
+	"input":                 "Reads one byte of input into a variable, or -1 at the end of input.",
+	"memset":                "Stores a value at a memory address.",
+	"memget":                "Loads the value at a memory address into a variable.",
+	"debug":                 "Prints each argument along with its value.",
+	"vm_no_input_buffering": "Makes input read keys as they are pressed.",
+	"read_file":             "Reads a file into memory and stores its length in a variable.",
+	"write_file":            "Writes cells of memory to a file, one byte each.",
+	"getenv":                "Reads an environment variable into memory and stores its length in a variable, or -1 if it is not set.",
+	"time_ms":               "Stores the Unix time in milliseconds in a variable.",
+	"sleep_ms":              "Pauses the program for a number of milliseconds.",
+}
+
+// Server is a language server for ez documents. Diagnostics are checked
+// against the functions registered on VM.
+type Server struct {
+	VM *vm.VM
+
+	in   *bufio.Reader
+	out  io.Writer
+	docs map[string]*document
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	executor := vm.New(0)
+	executor.Grant(vm.Unrestricted())
+
+	return &Server{
+		VM:   executor,
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: map[string]*document{},
+	}
+}
+
+type requestError struct {
+	code    int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+// Serve handles messages until the client sends exit.
+func (s *Server) Serve() error {
+	for {
+		msg, err := readMessage(s.in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(msg)
+
+		// Notifications have no ID and get no response.
+		if msg.ID == nil {
+			continue
+		}
+
+		res := response{JSONRPC: "2.0", ID: msg.ID, Result: result}
+
+		var reqErr requestError
+		if errors.As(err, &reqErr) {
+			res.Error = &responseError{Code: reqErr.code, Message: reqErr.message}
+		} else if err != nil {
+			res.Error = &responseError{Code: codeInvalidParams, Message: err.Error()}
+		}
+
+		if err := writeMessage(s.out, res); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg message) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // full
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]any{},
+			},
+			"serverInfo": map[string]string{"name": "ez"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+
+		delete(s.docs, params.TextDocument.URI)
+
+		return nil, s.publish(params.TextDocument.URI, []diagnostic{})
+	case "textDocument/definition":
+		return withPosition(s, msg, s.definition)
+	case "textDocument/references":
+		return withPosition(s, msg, s.references)
+	case "textDocument/completion":
+		return withPosition(s, msg, s.completion)
+	case "textDocument/hover":
+		return withPosition(s, msg, s.hover)
+	case "textDocument/documentSymbol":
+		var params documentParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+
+		doc, ok := s.docs[params.TextDocument.URI]
+		if !ok {
+			return []documentSymbol{}, nil
+		}
+
+		return doc.symbols(), nil
+	}
+
+	if msg.ID == nil {
+		return nil, nil
+	}
+
+	return nil, requestError{code: codeMethodNotFound, message: "method not found: " + msg.Method}
+}
+
+func withPosition[T any](s *Server, msg message, fn func(*document, positionParams) T) (any, error) {
+	var params positionParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return nil, err
+	}
+
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok {
+		return nil, nil
+	}
+
+	return fn(doc, params), nil
+}
+
+func (s *Server) update(uri, text string) error {
+	doc := analyze(uri, text, s.VM)
+	s.docs[uri] = doc
+
+	diags := []diagnostic{}
+
+	for _, diag := range doc.diags {
+		severity := 1
+		if diag.Severity == lexer.SeverityWarning {
+			severity = 2
+		}
+
+		message := diag.Message
+		if diag.Tip != "" {
+			message += " (" + diag.Tip + ")"
+		}
+
+		diags = append(diags, diagnostic{
+			Range:    doc.span(diag.Context, max(diag.Length, 1)),
+			Severity: severity,
+			Source:   "ez " + diag.Step,
+			Message:  message,
+		})
+	}
+
+	return s.publish(uri, diags)
+}
+
+func (s *Server) publish(uri string, diags []diagnostic) error {
+	return writeMessage(s.out, notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  publishDiagnosticsParams{URI: uri, Diagnostics: diags},
+	})
+}
+
+func (d *document) tokenRange(token lexer.Token) textRange {
+	return d.span(token.Context, token.Length)
+}
+
+func (d *document) location(token lexer.Token) location {
+	return location{URI: d.uri, Range: d.tokenRange(token)}
+}
+
+func (d *document) locations(tokens []lexer.Token) []location {
+	locations := []location{}
+
+	for _, token := range tokens {
+		locations = append(locations, d.location(token))
+	}
+
+	return locations
+}
+
+// definition goes from a jump to its label, or from a call to its function.
+func (s *Server) definition(doc *document, params positionParams) []location {
+	token, ok := doc.tokenAt(params.Position)
+	if !ok {
+		return nil
+	}
+
+	sc := doc.scopeAt(token.Context.Line)
+
+	if token.Type == lexer.TTLabel {
+		return []location{doc.location(token)}
+	}
+
+	if sc.contains(sc.jumps, token) {
+		if label, ok := sc.labels[token.Data]; ok {
+			return []location{doc.location(label)}
+		}
+
+		return nil
+	}
+
+	if fn, ok := doc.funcs[token.Data]; ok && token.Type == lexer.TTIdentifier && !sc.contains(sc.vars, token) {
+		return []location{doc.location(fn.Token)}
+	}
+
+	return nil
+}
+
+// references finds the uses of a label or a variable.
+func (s *Server) references(doc *document, params positionParams) []location {
+	token, ok := doc.tokenAt(params.Position)
+	if !ok {
+		return nil
+	}
+
+	sc := doc.scopeAt(token.Context.Line)
+
+	switch {
+	case token.Type == lexer.TTLabel || sc.contains(sc.jumps, token):
+		return doc.locations(doc.labelRefs(sc, token.Data, params.Context.IncludeDeclaration))
+	case sc.contains(sc.vars, token):
+		return doc.locations(doc.varRefs(sc, token.Data))
+	}
+
+	return nil
+}
+
+// completion offers labels after goto and gosub, functions after call, and
+// otherwise variables, user functions and keywords.
+func (s *Server) completion(doc *document, params positionParams) []completionItem {
+	sc := doc.scopeAt(params.Position.Line + 1)
+	items := []completionItem{}
+
+	prev, _ := doc.previous(params.Position)
+
+	switch prev.Type {
+	case lexer.TTKeywordGoto, lexer.TTKeywordGosub:
+		for _, name := range sortedKeys(sc.labels) {
+			items = append(items, completionItem{Label: name, Kind: completionLabel})
+		}
+
+		return items
+	case lexer.TTKeywordCall:
+		for _, name := range sortedKeys(s.VM.Funcs) {
+			items = append(items, completionItem{Label: name, Kind: completionFunction, Detail: s.signature(name)})
+		}
+
+		return append(items, doc.funcItems()...)
+	}
+
+	for _, name := range doc.visibleVars(sc) {
+		items = append(items, completionItem{Label: name, Kind: completionVariable})
+	}
+
+	items = append(items, doc.funcItems()...)
+
+	for _, keyword := range sortedKeys(lexer.Keywords) {
+		items = append(items, completionItem{Label: keyword, Kind: completionKeyword})
+	}
+
+	return items
+}
+
+func (d *document) funcItems() []completionItem {
+	items := []completionItem{}
+
+	for _, name := range sortedKeys(d.funcs) {
+		fn := d.funcs[name]
+		items = append(items, completionItem{Label: name, Kind: completionFunction, Detail: funcSignature(fn.Name, fn.Params)})
+	}
+
+	return items
+}
+
+func funcSignature(name string, params []string) string {
+	return fmt.Sprintf("func %s(%s)", name, strings.Join(params, ", "))
+}
+
+func (s *Server) signature(name string) string {
+	if fn, ok := s.VM.Funcs[name]; ok {
+		return strings.TrimSpace(fmt.Sprintf("call %s %s", name, fn.Signature))
+	}
+
+	return fmt.Sprintf("call %s ...", name)
+}
+
+// hover shows the signature of builtins and user functions.
+func (s *Server) hover(doc *document, params positionParams) *hover {
+	token, ok := doc.tokenAt(params.Position)
+	if !ok || token.Type != lexer.TTIdentifier {
+		return nil
+	}
+
+	sc := doc.scopeAt(token.Context.Line)
+	if sc.contains(sc.vars, token) || sc.contains(sc.jumps, token) {
+		return nil
+	}
+
+	var text string
+
+	if fn, ok := doc.funcs[token.Data]; ok {
+		text = "```ez\n" + funcSignature(fn.Name, fn.Params) + "\n```"
+	} else if _, ok := s.VM.Funcs[token.Data]; ok {
+		text = "```ez\n" + s.signature(token.Data) + "\n```"
+		if doc, ok := builtinDocs[token.Data]; ok {
+			text += "\n\n" + doc
+		}
+	} else {
+		return nil
+	}
+
+	return &hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: doc.tokenRange(token)}
+}
+
+// symbols lists the functions and the labels of each scope.
+func (d *document) symbols() []documentSymbol {
+	labels := func(sc *scope) []documentSymbol {
+		symbols := []documentSymbol{}
+
+		for _, name := range sortedKeys(sc.labels) {
+			token := sc.labels[name]
+			symbols = append(symbols, documentSymbol{Name: name, Kind: symbolKey, Range: d.tokenRange(token), SelectionRange: d.tokenRange(token)})
+		}
+
+		return symbols
+	}
+
+	symbols := labels(d.scopes[0])
+
+	for _, sc := range d.scopes[1:] {
+		name := sc.fn.Token
+		whole := textRange{Start: position{Line: sc.first - 1}, End: position{Line: sc.last}}
+
+		symbols = append(symbols, documentSymbol{
+			Name:           name.Data,
+			Detail:         funcSignature(sc.fn.Name, sc.fn.Params),
+			Kind:           symbolFunction,
+			Range:          whole,
+			SelectionRange: d.tokenRange(name),
+			Children:       labels(sc),
+		})
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].SelectionRange.Start.Line < symbols[j].SelectionRange.Start.Line
+	})
+
+	return symbols
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,154 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinDocs(t *testing.T) {
+	s := NewServer(strings.NewReader(""), &strings.Builder{})
+
+	for name := range builtinDocs {
+		if _, ok := s.VM.Funcs[name]; !ok {
+			t.Errorf("%s is documented but not registered", name)
+		}
+	}
+
+	for name := range s.VM.Funcs {
+		if _, ok := builtinDocs[name]; !ok {
+			t.Errorf("%s is registered but not documented", name)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	s := NewServer(strings.NewReader(""), &strings.Builder{})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"shown", "call shown <number>"},
+		{"read_file", `call read_file "filename" <addr> <length_var>`},
+		{"debug", "call debug [<value>...]"},
+		{"vm_no_input_buffering", "call vm_no_input_buffering"},
+		{"missing", "call missing ..."},
+	}
+
+	for _, test := range tests {
+		if got := s.signature(test.name); got != test.want {
+			t.Errorf("signature(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+const navigationSource = `x = 1
+func f(a)
+    x = a
+    return x
+end
+:loop
+    x = f(x)
+    if x < 5 goto loop
+func g()
+    return x + 1
+end
+`
+
+func TestNavigation(t *testing.T) {
+	s := NewServer(strings.NewReader(""), &strings.Builder{})
+	doc := analyze("file:///test.ez", navigationSource, s.VM)
+
+	if len(doc.diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", doc.diags)
+	}
+
+	tests := []struct {
+		name        string
+		at          position
+		definitions []position
+		references  []position
+	}{
+		{"jump to label", position{7, 18}, []position{{5, 0}}, []position{{5, 0}, {7, 18}}},
+		{"call to function", position{6, 8}, []position{{1, 5}}, nil},
+		{"global", position{0, 0}, nil, []position{{0, 0}, {6, 4}, {6, 10}, {7, 7}, {9, 11}}},
+		{"global in function", position{9, 11}, nil, []position{{0, 0}, {6, 4}, {6, 10}, {7, 7}, {9, 11}}},
+		{"local", position{3, 11}, nil, []position{{2, 4}, {3, 11}}},
+	}
+
+	starts := func(locations []location) []position {
+		positions := []position{}
+		for _, location := range locations {
+			positions = append(positions, location.Range.Start)
+		}
+
+		return positions
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := positionParams{Position: test.at}
+			params.Context.IncludeDeclaration = true
+
+			if got := starts(s.definition(doc, params)); fmt.Sprint(got) != fmt.Sprint(test.definitions) {
+				t.Errorf("definition = %v, want %v", got, test.definitions)
+			}
+
+			if got := starts(s.references(doc, params)); fmt.Sprint(got) != fmt.Sprint(test.references) {
+				t.Errorf("references = %v, want %v", got, test.references)
+			}
+		})
+	}
+}
+
+func TestPublishDiagnostics(t *testing.T) {
+	var out strings.Builder
+	s := NewServer(strings.NewReader(""), &out)
+
+	if err := s.update("file:///test.ez", "x = 1\ngoto nowhere\ncall shown 1 $\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := readMessage(bufio.NewReader(strings.NewReader(out.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var params publishDiagnosticsParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Method != "textDocument/publishDiagnostics" || params.URI != "file:///test.ez" || len(params.Diagnostics) != 1 {
+		t.Fatalf("published %s %s", msg.Method, msg.Params)
+	}
+
+	// Lexing errors stop checking, so the missing label is not reported.
+	diag := params.Diagnostics[0]
+	if diag.Message != "Unexpected character: $" || diag.Range.Start != (position{Line: 2, Character: 13}) || diag.Source != "ez lexing" {
+		t.Fatalf("diagnostic %+v", diag)
+	}
+}
+
+// Positions count UTF-16 code units, so a character outside the Basic
+// Multilingual Plane counts twice and one with a two-byte encoding once.
+func TestUTF16Positions(t *testing.T) {
+	s := NewServer(strings.NewReader(""), &strings.Builder{})
+	doc := analyze("file:///test.ez", "x = 1\ny = /* é😀 */ x\n", s.VM)
+
+	params := positionParams{Position: position{Line: 1, Character: 14}}
+	params.Context.IncludeDeclaration = true
+
+	refs := s.references(doc, params)
+	if len(refs) != 2 {
+		t.Fatalf("got %d references, want 2", len(refs))
+	}
+
+	want := textRange{Start: position{Line: 1, Character: 14}, End: position{Line: 1, Character: 15}}
+	if refs[1].Range != want {
+		t.Fatalf("range %+v, want %+v", refs[1].Range, want)
+	}
+}
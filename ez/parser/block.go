@@ -0,0 +1,353 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+// Block statements are lowered into labels, gotos and if-gotos so the VM only
+// ever sees the flat jump-based statements. Generated labels and variables are
+// prefixed with "__" and numbered per program to keep them unique.
+
+type loop struct {
+	breakLabel    string
+	continueLabel string
+}
+
+var negatedComparisons = map[string]string{
+	"==": "!=",
+	"!=": "==",
+	"<":  ">=",
+	">":  "<=",
+	"<=": ">",
+	">=": "<",
+}
+
+func (c *cursor) newLabel(kind string) string {
+	label := fmt.Sprintf("__%s_%d", kind, c.labels)
+	c.labels++
+
+	return label
+}
+
+// negate returns the opposite of a condition, flipping a comparison where it
+// can rather than wrapping it in not.
+func negate(cond Expr) Expr {
+	switch expr := cond.(type) {
+	case BinaryExpr:
+		if op, ok := negatedComparisons[expr.Op]; ok {
+			expr.Op = op
+			return expr
+		}
+	case UnaryExpr:
+		if expr.Op == "not" {
+			return expr.Operand
+		}
+	}
+
+	return UnaryExpr{Op: "not", Operand: cond, Token: lexer.Token{Type: lexer.TTOpNot, Data: "not", Context: cond.Context()}}
+}
+
+func jumpTo(label string, token lexer.Token) Goto {
+	return Goto{
+		Name:  label,
+		Token: token,
+	}
+}
+
+func varRef(name string, token lexer.Token) Value {
+	return Value{
+		Type:  ValueTypeVar,
+		Value: name,
+		Token: token,
+	}
+}
+
+// parseBlock parses statements until one of the terminating keywords starts a
+// line, and returns the body along with the terminator it stopped at.
+func parseBlock(c *cursor, start lexer.Token, terminators ...lexer.TokenType) ([]Stmt, lexer.Token, error) {
+	body := []Stmt{}
+
+	for !c.atEnd() {
+		token := c.peek()
+
+		if token.Type == lexer.TTEndStmt {
+			c.advance()
+			continue
+		}
+
+		for _, t := range terminators {
+			if token.Type == t {
+				c.advance()
+				return body, token, nil
+			}
+		}
+
+		stmts, err := parseLine(c)
+		if err != nil {
+			c.recover(err)
+			continue
+		}
+
+		body = append(body, stmts...)
+	}
+
+	return nil, lexer.Token{}, start.Error(STEP, fmt.Sprintf("Unterminated %s block", start.Data), "Blocks must be closed with 'end'")
+}
+
+// if <cond> then ... [else ...] end
+func parseIfBlock(c *cursor, start lexer.Token, cond Expr) ([]Stmt, error) {
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	endLabel := c.newLabel("if_end")
+
+	body, terminator, err := parseBlock(c, start, lexer.TTKeywordElse, lexer.TTKeywordEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	if terminator.Type == lexer.TTKeywordEnd {
+		stmts := []Stmt{If{Cond: negate(cond), Goto: jumpTo(endLabel, start)}}
+		stmts = append(stmts, body...)
+
+		return append(stmts, Label{Name: endLabel}), nil
+	}
+
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	elseBody, _, err := parseBlock(c, start, lexer.TTKeywordEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	elseLabel := c.newLabel("if_else")
+
+	stmts := []Stmt{If{Cond: negate(cond), Goto: jumpTo(elseLabel, start)}}
+	stmts = append(stmts, body...)
+	stmts = append(stmts, jumpTo(endLabel, terminator), Label{Name: elseLabel})
+	stmts = append(stmts, elseBody...)
+
+	return append(stmts, Label{Name: endLabel}), nil
+}
+
+// while <cond> do ... end
+func parseWhile(c *cursor) ([]Stmt, error) {
+	start := c.advance()
+
+	cond, err := parseCondition(c)
+	if err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	if _, err := c.expect("Expected 'do'", lexer.TTKeywordDo); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	startLabel := c.newLabel("while_start")
+	endLabel := c.newLabel("while_end")
+
+	c.loops = append(c.loops, loop{breakLabel: endLabel, continueLabel: startLabel})
+	body, _, err := parseBlock(c, start, lexer.TTKeywordEnd)
+	c.loops = c.loops[:len(c.loops)-1]
+
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := []Stmt{
+		Label{Name: startLabel},
+		If{Cond: negate(cond), Goto: jumpTo(endLabel, start)},
+	}
+	stmts = append(stmts, body...)
+
+	return append(stmts, jumpTo(startLabel, start), Label{Name: endLabel}), nil
+}
+
+// stepSign returns the sign of a step expression if it is known at parse time,
+// or 0 if it has to be checked when the loop runs.
+func stepSign(step Expr) int {
+	negative := false
+
+	if unary, ok := step.(UnaryExpr); ok && unary.Op == "-" {
+		negative = true
+		step = unary.Operand
+	}
+
+	val, ok := step.(Value)
+	if !ok || val.Type != ValueTypeInt {
+		return 0
+	}
+
+	if negative || strings.HasPrefix(val.Value, "-") {
+		return -1
+	}
+
+	return 1
+}
+
+// constant reports whether an expression is an integer literal, which a loop
+// can use as is rather than keeping its value in a temporary.
+func constant(expr Expr) bool {
+	if unary, ok := expr.(UnaryExpr); ok && unary.Op == "-" {
+		expr = unary.Operand
+	}
+
+	val, ok := expr.(Value)
+
+	return ok && val.Type == ValueTypeInt
+}
+
+// for <var> = <from> to <to> [step <step>] ... end
+//
+// The bound and step are evaluated once before the first iteration. The loop
+// runs while the variable has not passed the bound in the direction of the step,
+// and ends rather than wrapping around when the next step would overflow.
+func parseFor(c *cursor) ([]Stmt, error) {
+	start := c.advance()
+
+	name, err := c.expect("Expected loop variable", lexer.TTIdentifier)
+	if err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	if _, err := c.expect("Expected '='", lexer.TTOpAssign); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	from, err := parseExpr(c)
+	if err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	if _, err := c.expect("Expected 'to'", lexer.TTKeywordTo); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	to, err := parseExpr(c)
+	if err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	var step Expr = Value{Type: ValueTypeInt, Value: "1", Token: start}
+	if c.peek().Type == lexer.TTKeywordStep {
+		c.advance()
+
+		step, err = parseExpr(c)
+		if err != nil {
+			return nil, c.skipBlock(err)
+		}
+	}
+
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return nil, c.skipBlock(err)
+	}
+
+	startLabel := c.newLabel("for_start")
+	bodyLabel := c.newLabel("for_body")
+	negativeLabel := c.newLabel("for_negative")
+	nextLabel := c.newLabel("for_next")
+	endLabel := c.newLabel("for_end")
+
+	c.loops = append(c.loops, loop{breakLabel: endLabel, continueLabel: nextLabel})
+	body, _, err := parseBlock(c, start, lexer.TTKeywordEnd)
+	c.loops = c.loops[:len(c.loops)-1]
+
+	if err != nil {
+		return nil, err
+	}
+
+	counter := varRef(name.Data, name)
+
+	stmts := []Stmt{VarDecl{Name: name.Data, Value: from, Token: name}}
+
+	if !constant(to) {
+		stmts = append(stmts, VarDecl{Name: endLabel + "_to", Value: to, Token: start, Local: true})
+		to = varRef(endLabel+"_to", start)
+	}
+
+	sign := stepSign(step)
+	if !constant(step) {
+		stmts = append(stmts, VarDecl{Name: endLabel + "_step", Value: step, Token: start, Local: true})
+		step = varRef(endLabel+"_step", start)
+	}
+
+	// exit leaves the loop when the counter compares to the limit with op.
+	exit := func(op string, limit Expr) Stmt {
+		return If{Cond: BinaryExpr{Op: op, Lhs: counter, Rhs: limit, Token: start}, Goto: jumpTo(endLabel, start)}
+	}
+
+	// Past these limits, adding the step would overflow.
+	highest := BinaryExpr{Op: "-", Lhs: Value{Type: ValueTypeInt, Value: "9223372036854775807", Token: start}, Rhs: step, Token: start}
+	lowest := BinaryExpr{Op: "-", Lhs: Value{Type: ValueTypeInt, Value: "-9223372036854775808", Token: start}, Rhs: step, Token: start}
+
+	next := []Stmt{Label{Name: nextLabel}}
+	stmts = append(stmts, Label{Name: startLabel})
+
+	switch sign {
+	case 1:
+		stmts = append(stmts, exit(">", to))
+		next = append(next, exit(">", highest))
+	case -1:
+		stmts = append(stmts, exit("<", to))
+		next = append(next, exit("<", lowest))
+	default:
+		negative := If{Cond: BinaryExpr{Op: "<", Lhs: step, Rhs: Value{Type: ValueTypeInt, Value: "0", Token: start}, Token: start}, Goto: jumpTo(negativeLabel, start)}
+		nextNegativeLabel := c.newLabel("for_next_negative")
+		stepLabel := c.newLabel("for_step")
+
+		stmts = append(stmts,
+			negative,
+			exit(">", to),
+			jumpTo(bodyLabel, start),
+			Label{Name: negativeLabel},
+			exit("<", to),
+			Label{Name: bodyLabel},
+		)
+
+		negative.Goto = jumpTo(nextNegativeLabel, start)
+		next = append(next,
+			negative,
+			exit(">", highest),
+			jumpTo(stepLabel, start),
+			Label{Name: nextNegativeLabel},
+			exit("<", lowest),
+			Label{Name: stepLabel},
+		)
+	}
+
+	stmts = append(stmts, body...)
+	stmts = append(stmts, next...)
+
+	return append(stmts,
+		VarDecl{Name: name.Data, Value: BinaryExpr{Op: "+", Lhs: counter, Rhs: step, Token: start}, Token: name},
+		jumpTo(startLabel, start),
+		Label{Name: endLabel},
+	), nil
+}
+
+// break / continue
+func parseLoopJump(c *cursor) (Goto, error) {
+	token := c.advance()
+
+	if len(c.loops) == 0 {
+		return Goto{}, token.Error(STEP, fmt.Sprintf("'%s' outside of loop", token.Data))
+	}
+
+	current := c.loops[len(c.loops)-1]
+
+	if token.Type == lexer.TTKeywordBreak {
+		return jumpTo(current.breakLabel, token), nil
+	}
+
+	return jumpTo(current.continueLabel, token), nil
+}
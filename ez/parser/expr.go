@@ -0,0 +1,258 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+// Binding power of each binary operator, higher binds tighter. Logical
+// operators bind loosest, then comparisons, which yield 0 or 1. Bitwise
+// operators bind looser than arithmetic, in the same order as in C.
+var binaryPrecedence = map[lexer.TokenType]int{
+	lexer.TTOpOr:     1,
+	lexer.TTOpAnd:    2,
+	lexer.TTOpLt:     4,
+	lexer.TTOpGt:     4,
+	lexer.TTOpLte:    4,
+	lexer.TTOpGte:    4,
+	lexer.TTOpEq:     4,
+	lexer.TTOpNeq:    4,
+	lexer.TTOpBitOr:  5,
+	lexer.TTOpXor:    6,
+	lexer.TTOpBitAnd: 7,
+	lexer.TTOpShl:    8,
+	lexer.TTOpShr:    8,
+	lexer.TTOpUshr:   8,
+	lexer.TTOpAdd:    9,
+	lexer.TTOpSub:    9,
+	lexer.TTOpMul:    10,
+	lexer.TTOpDiv:    10,
+	lexer.TTOpMod:    10,
+	lexer.TTOpPow:    12,
+}
+
+var rightAssociative = map[lexer.TokenType]bool{
+	lexer.TTOpPow: true,
+}
+
+// Unary minus and ~ bind tighter than multiplication but looser than ^, so
+// -2^2 is -(2^2). not binds looser than comparisons, so not a == b is
+// not (a == b).
+const (
+	unaryPrecedence = 11
+	notPrecedence   = 3
+)
+
+func parseExpr(c *cursor) (Expr, error) {
+	return parseBinary(c, 1)
+}
+
+func parseBinary(c *cursor, minPrecedence int) (Expr, error) {
+	lhs, err := parseUnary(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := c.peek()
+
+		precedence, ok := binaryPrecedence[op.Type]
+		if !ok || precedence < minPrecedence {
+			return lhs, nil
+		}
+
+		if c.args && startsArgument(c.tokens[c.index-1], op, c.peekAt(1)) {
+			return lhs, nil
+		}
+
+		c.advance()
+
+		next := precedence + 1
+		if rightAssociative[op.Type] {
+			next = precedence
+		}
+
+		rhs, err := parseBinary(c, next)
+		if err != nil {
+			return nil, err
+		}
+
+		lhs = BinaryExpr{
+			Op:    op.Data,
+			Lhs:   lhs,
+			Rhs:   rhs,
+			Token: op,
+		}
+	}
+}
+
+func parseUnary(c *cursor) (Expr, error) {
+	if c.peek().Type != lexer.TTOpSub && c.peek().Type != lexer.TTOpBitNot && c.peek().Type != lexer.TTOpNot {
+		return parsePrimary(c)
+	}
+
+	op := c.advance()
+
+	precedence := unaryPrecedence
+	if op.Type == lexer.TTOpNot {
+		precedence = notPrecedence
+	}
+
+	// A minus sign before a literal makes a negative literal, unless the literal
+	// is raised to a power. This is also the only way to write the smallest int.
+	if literal := c.peek(); op.Type == lexer.TTOpSub && literal.Type == lexer.TTLiteralInt && c.peekAt(1).Type != lexer.TTOpPow {
+		c.advance()
+
+		return Value{
+			Type:  ValueTypeInt,
+			Value: "-" + literal.Data,
+			Token: lexer.Token{
+				Type:    lexer.TTLiteralInt,
+				Length:  literal.Context.Index + literal.Length - op.Context.Index,
+				Data:    "-" + literal.Data,
+				Context: op.Context,
+			},
+		}, nil
+	}
+
+	operand, err := parseBinary(c, precedence)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnaryExpr{
+		Op:      op.Data,
+		Operand: operand,
+		Token:   op,
+	}, nil
+}
+
+func parsePrimary(c *cursor) (Expr, error) {
+	token := c.peek()
+
+	switch token.Type {
+	case lexer.TTIdentifier:
+		if isCall(token, c.peekAt(1)) {
+			return parseCallExpr(c)
+		}
+
+		fallthrough
+	case lexer.TTLiteralInt, lexer.TTLiteralStr:
+		c.advance()
+
+		if _, err := strconv.ParseInt(token.Data, 10, 64); token.Type == lexer.TTLiteralInt && err != nil {
+			return nil, token.Error(STEP, "Integer literal out of range", lexer.IntRangeTip)
+		}
+
+		return Value{
+			Type:  valueTypeFromToken(token.Type),
+			Value: token.Data,
+			Token: token,
+		}, nil
+	case lexer.TTLParen:
+		c.advance()
+		defer c.grouped()()
+
+		expr, err := parseExpr(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := c.expect("Expected ')'", lexer.TTRParen); err != nil {
+			return nil, err
+		}
+
+		return expr, nil
+	}
+
+	if lexer.IsKeyword(token.Data) {
+		return nil, token.Error(STEP, "Expected expression", fmt.Sprintf("'%s' is a reserved keyword and cannot be used as a name", token.Data))
+	}
+
+	return nil, token.Error(STEP, "Expected expression", "Expressions are made of literals, identifiers, operators and parentheses")
+}
+
+// isCall reports whether an identifier is immediately followed by an opening
+// parenthesis, as in f(x). With a space in between, as in "call debug a (b)",
+// the parenthesis starts a separate expression instead.
+func isCall(name, next lexer.Token) bool {
+	return next.Type == lexer.TTLParen && name.Adjacent(next)
+}
+
+// startsArgument reports whether a minus sign in the arguments of a call
+// statement starts a new, negative argument rather than subtracting, as in
+// "call memset 1 -5": it has a space before it and none after. Inside
+// parentheses it always subtracts.
+func startsArgument(prev, op, next lexer.Token) bool {
+	return op.Type == lexer.TTOpSub && !prev.Adjacent(op) && op.Adjacent(next)
+}
+
+// grouped stops call statement arguments from being split until the returned
+// function is called, for parsing inside parentheses.
+func (c *cursor) grouped() func() {
+	args := c.args
+	c.args = false
+
+	return func() { c.args = args }
+}
+
+func parseCallExpr(c *cursor) (Expr, error) {
+	name := c.advance()
+	c.advance()
+	defer c.grouped()()
+
+	args := []Expr{}
+
+	if c.peek().Type == lexer.TTRParen {
+		c.advance()
+
+		return CallExpr{Name: name.Data, Args: args, Token: name}, nil
+	}
+
+	for {
+		arg, err := parseExpr(c)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		sep, err := c.expect("Expected ',' or ')'", lexer.TTComma, lexer.TTRParen)
+		if err != nil {
+			return nil, err
+		}
+
+		if sep.Type == lexer.TTRParen {
+			break
+		}
+	}
+
+	return CallExpr{
+		Name:  name.Data,
+		Args:  args,
+		Token: name,
+	}, nil
+}
+
+// ParseExpr parses tokens holding a single expression, such as a debugger
+// condition.
+func ParseExpr(tokens []lexer.Token) (Expr, error) {
+	if len(tokens) == 0 {
+		return nil, lexer.TokenContext{}.Error(STEP, "Expected expression")
+	}
+
+	c := &cursor{tokens: tokens, funcs: map[string]bool{}}
+
+	expr, err := parseExpr(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.expect("Expected end of expression", lexer.TTEndStmt); err != nil {
+		return nil, err
+	}
+
+	return expr, nil
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+func parseParams(c *cursor) ([]string, error) {
+	if _, err := c.expect("Expected '('", lexer.TTLParen); err != nil {
+		return nil, err
+	}
+
+	params := []string{}
+	seen := map[string]bool{}
+
+	if c.peek().Type == lexer.TTRParen {
+		c.advance()
+		return params, nil
+	}
+
+	for {
+		param, err := c.expect("Expected parameter name", lexer.TTIdentifier)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[param.Data] {
+			return nil, param.Error(STEP, fmt.Sprintf("Duplicate parameter: %s", param.Data))
+		}
+
+		seen[param.Data] = true
+		params = append(params, param.Data)
+
+		sep, err := c.expect("Expected ',' or ')'", lexer.TTComma, lexer.TTRParen)
+		if err != nil {
+			return nil, err
+		}
+
+		if sep.Type == lexer.TTRParen {
+			return params, nil
+		}
+	}
+}
+
+// func <name>(<params>) ... end
+//
+// The body gets an implicit "return 0" for bodies that fall off the end.
+func parseFunc(c *cursor) (Func, error) {
+	start := c.advance()
+
+	if c.inFunc {
+		return Func{}, c.skipBlock(start.Error(STEP, "Functions cannot be nested"))
+	}
+
+	name, err := c.expect("Expected function name", lexer.TTIdentifier)
+	if err != nil {
+		return Func{}, c.skipBlock(err)
+	}
+
+	if c.funcs[name.Data] {
+		return Func{}, c.skipBlock(name.Error(STEP, fmt.Sprintf("Duplicate function: %s", name.Data)))
+	}
+
+	c.funcs[name.Data] = true
+
+	params, err := parseParams(c)
+	if err != nil {
+		return Func{}, c.skipBlock(err)
+	}
+
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return Func{}, c.skipBlock(err)
+	}
+
+	loops := c.loops
+	c.loops = nil
+	c.inFunc = true
+
+	body, terminator, err := parseBlock(c, start, lexer.TTKeywordEnd)
+
+	c.loops = loops
+	c.inFunc = false
+
+	if err != nil {
+		return Func{}, err
+	}
+
+	body = append(body, Return{
+		Value: Value{Type: ValueTypeInt, Value: "0", Token: terminator},
+		Token: terminator,
+	})
+
+	return Func{
+		Name:   name.Data,
+		Params: params,
+		Body:   body,
+		Token:  name,
+	}, nil
+}
+
+// return [<expr>]
+func parseReturn(c *cursor) (Return, error) {
+	token := c.advance()
+
+	if c.peek().Type == lexer.TTEndStmt {
+		return Return{
+			Value: Value{Type: ValueTypeInt, Value: "0", Token: token},
+			Token: token,
+		}, nil
+	}
+
+	value, err := parseExpr(c)
+	if err != nil {
+		return Return{}, err
+	}
+
+	return Return{
+		Value: value,
+		Token: token,
+	}, nil
+}
+
+// gosub <label>
+func parseGosub(c *cursor) (Gosub, error) {
+	c.advance()
+
+	label, err := c.expectLabel()
+	if err != nil {
+		return Gosub{}, err
+	}
+
+	return Gosub{
+		Name:  label.Data,
+		Token: label,
+	}, nil
+}
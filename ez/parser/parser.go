@@ -1,235 +1,441 @@
 package parser
 
 import (
+	"fmt"
+	"slices"
+
 	"github.com/vcokltfre/ez/ez/lexer"
 )
 
 const STEP = "parsing"
 
-func matchTokenPattern(pattern ...[]lexer.TokenType) func([]lexer.Token) bool {
-	return func(tokens []lexer.Token) bool {
-		if len(tokens) < len(pattern) {
-			return false
+// The binary operator each compound assignment applies.
+var compoundOperators = map[lexer.TokenType]string{
+	lexer.TTOpAddAssign:  "+",
+	lexer.TTOpSubAssign:  "-",
+	lexer.TTOpMulAssign:  "*",
+	lexer.TTOpDivAssign:  "/",
+	lexer.TTOpModAssign:  "%",
+	lexer.TTOpPowAssign:  "^",
+	lexer.TTOpAndAssign:  "&",
+	lexer.TTOpOrAssign:   "|",
+	lexer.TTOpShlAssign:  "<<",
+	lexer.TTOpShrAssign:  ">>",
+	lexer.TTOpUshrAssign: ">>>",
+}
+
+type cursor struct {
+	tokens []lexer.Token
+	index  int
+
+	labels int
+	loops  []loop
+	funcs  map[string]bool
+	inFunc bool
+
+	// args is set while parsing the arguments of a call statement, outside any
+	// parentheses.
+	args bool
+
+	diags lexer.Diagnostics
+}
+
+// recover records the error of a statement and skips to the end of its line,
+// so that parsing can carry on with the next statement.
+func (c *cursor) recover(err error) {
+	c.diags.Add(err)
+
+	for !c.atEnd() && c.peek().Type != lexer.TTEndStmt {
+		c.advance()
+	}
+}
+
+// skipBlock moves past the body of a block whose header could not be parsed,
+// stopping at the 'end' that closes it. Recovering from err then skips that
+// line, so the body is not parsed as statements of the enclosing block and its
+// 'end' is not reported again.
+func (c *cursor) skipBlock(err error) error {
+	depth := 1
+
+	for !c.atEnd() {
+		for !c.atEnd() && c.peek().Type != lexer.TTEndStmt {
+			c.advance()
 		}
 
-		for i, p := range pattern {
-			anyValid := false
+		for !c.atEnd() && c.peek().Type == lexer.TTEndStmt {
+			c.advance()
+		}
 
-			for _, t := range p {
-				if tokens[i].Type == t {
-					anyValid = true
-					break
-				}
+		switch c.peek().Type {
+		case lexer.TTKeywordWhile, lexer.TTKeywordFor, lexer.TTKeywordFunc:
+			depth++
+		case lexer.TTKeywordIf:
+			if !c.lineHas(lexer.TTKeywordGoto) {
+				depth++
 			}
+		case lexer.TTKeywordEnd:
+			depth--
+		}
 
-			if !anyValid {
-				return false
-			}
+		if depth == 0 {
+			break
 		}
+	}
 
-		return true
-	}
-}
-
-var (
-	matchVarDeclValue = matchTokenPattern(
-		[]lexer.TokenType{lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTOpAssign},
-		[]lexer.TokenType{lexer.TTLiteralInt, lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTEndStmt},
-	)
-	matchVarDeclExpr = matchTokenPattern(
-		[]lexer.TokenType{lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTOpAssign},
-		[]lexer.TokenType{lexer.TTLiteralInt, lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTOpAdd, lexer.TTOpSub, lexer.TTOpMul, lexer.TTOpDiv, lexer.TTOpMod, lexer.TTOpPow},
-		[]lexer.TokenType{lexer.TTLiteralInt, lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTEndStmt},
-	)
-	matchIf = matchTokenPattern(
-		[]lexer.TokenType{lexer.TTKeywordIf},
-		[]lexer.TokenType{lexer.TTLiteralInt, lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTOpLt, lexer.TTOpGt, lexer.TTOpLte, lexer.TTOpGte, lexer.TTOpEq, lexer.TTOpNeq},
-		[]lexer.TokenType{lexer.TTLiteralInt, lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTKeywordGoto},
-		[]lexer.TokenType{lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTEndStmt},
-	)
-	matchLabel = matchTokenPattern(
-		[]lexer.TokenType{lexer.TTLabel},
-		[]lexer.TokenType{lexer.TTEndStmt},
-	)
-	matchGoto = matchTokenPattern(
-		[]lexer.TokenType{lexer.TTKeywordGoto},
-		[]lexer.TokenType{lexer.TTIdentifier},
-		[]lexer.TokenType{lexer.TTEndStmt},
-	)
-)
+	return err
+}
 
-func matchCall(tokens []lexer.Token) bool {
-	if tokens[0].Type != lexer.TTKeywordCall {
-		return false
+// lineHas reports whether a token of type t comes before the end of the
+// current statement.
+func (c *cursor) lineHas(t lexer.TokenType) bool {
+	for i := c.index; i < len(c.tokens) && c.tokens[i].Type != lexer.TTEndStmt; i++ {
+		if c.tokens[i].Type == t {
+			return true
+		}
 	}
 
-	if tokens[1].Type != lexer.TTIdentifier {
-		return false
+	return false
+}
+
+func (c *cursor) atEnd() bool {
+	return c.index >= len(c.tokens)
+}
+
+func (c *cursor) peek() lexer.Token {
+	if c.index >= len(c.tokens) {
+		return c.tokens[len(c.tokens)-1]
 	}
 
-	index := 2
-	for index < len(tokens) && (tokens[index].Type == lexer.TTLiteralInt ||
-		tokens[index].Type == lexer.TTIdentifier ||
-		tokens[index].Type == lexer.TTLiteralStr) {
-		index++
+	return c.tokens[c.index]
+}
+
+func (c *cursor) peekAt(offset int) lexer.Token {
+	if c.index+offset >= len(c.tokens) {
+		return c.tokens[len(c.tokens)-1]
 	}
 
-	if index >= len(tokens) || tokens[index].Type != lexer.TTEndStmt {
-		return false
+	return c.tokens[c.index+offset]
+}
+
+func (c *cursor) advance() lexer.Token {
+	token := c.peek()
+
+	if c.index < len(c.tokens) {
+		c.index++
 	}
 
-	return true
+	return token
 }
 
-func parseVarDeclValue(tokens []lexer.Token) VarDeclValue {
-	assignTo := tokens[0]
-	assignFrom := tokens[2]
+func (c *cursor) expect(message string, types ...lexer.TokenType) (lexer.Token, error) {
+	token := c.peek()
 
-	return VarDeclValue{
-		Name: assignTo.Data,
-		Value: Value{
-			Type:  valueTypeFromToken(assignFrom.Type),
-			Value: assignFrom.Data,
-			Token: assignFrom,
-		},
+	for _, t := range types {
+		if token.Type == t {
+			c.advance()
+			return token, nil
+		}
 	}
+
+	if slices.Contains(types, lexer.TTIdentifier) && lexer.IsKeyword(token.Data) {
+		return token, reserved(token)
+	}
+
+	return token, token.Error(STEP, message)
 }
 
-func parseVarDeclExpr(tokens []lexer.Token) VarDeclExpr {
-	assignTo := tokens[0]
-	lhsValue := tokens[2]
-	op := tokens[3]
-	rhsValue := tokens[4]
-
-	return VarDeclExpr{
-		Name: assignTo.Data,
-		Expr: OpExpr{
-			Op: op.Data,
-			Lhs: Value{
-				Type:  valueTypeFromToken(lhsValue.Type),
-				Value: lhsValue.Data,
-				Token: lhsValue,
-			},
-			Rhs: Value{
-				Type:  valueTypeFromToken(rhsValue.Type),
-				Value: rhsValue.Data,
-				Token: rhsValue,
-			},
-		},
+// expectLabel reads the name of the label a jump goes to. Since nothing else
+// can follow a jump, a keyword there is taken as a label name, so that jumps
+// like "goto end" keep working.
+func (c *cursor) expectLabel() (lexer.Token, error) {
+	token := c.peek()
+
+	if token.Type != lexer.TTIdentifier && lexer.IsKeyword(token.Data) {
+		c.advance()
+		token.Type = lexer.TTIdentifier
+
+		return token, nil
+	}
+
+	return c.expect("Expected label name", lexer.TTIdentifier)
+}
+
+// reserved reports a keyword used as the name of a variable or function.
+func reserved(token lexer.Token) error {
+	return token.Error(STEP, fmt.Sprintf("'%s' is a reserved keyword", token.Data), "Keywords cannot be used as variable, function or parameter names")
+}
+
+func parseVarDecl(c *cursor) (VarDecl, error) {
+	name := c.advance()
+
+	if _, err := c.expect("Expected '='", lexer.TTOpAssign); err != nil {
+		return VarDecl{}, err
+	}
+
+	value, err := parseExpr(c)
+	if err != nil {
+		return VarDecl{}, err
 	}
+
+	return VarDecl{
+		Name:  name.Data,
+		Value: value,
+		Token: name,
+	}, nil
+}
+
+// <var> += <expr>, and the other compound assignments
+//
+// These are lowered to <var> = <var> + (<expr>).
+func parseCompoundAssign(c *cursor) (VarDecl, error) {
+	name := c.advance()
+	op := c.advance()
+
+	value, err := parseExpr(c)
+	if err != nil {
+		return VarDecl{}, err
+	}
+
+	return update(name, op, compoundOperators[op.Type], value), nil
 }
 
-func parseIf(tokens []lexer.Token) If {
-	condLhs := tokens[1]
-	condOp := tokens[2]
-	condRhs := tokens[3]
-	gotoLabel := tokens[5]
-
-	return If{
-		Cond: OpExpr{
-			Op: condOp.Data,
-			Lhs: Value{
-				Type:  valueTypeFromToken(condLhs.Type),
-				Value: condLhs.Data,
-				Token: condLhs,
-			},
-			Rhs: Value{
-				Type:  valueTypeFromToken(condRhs.Type),
-				Value: condRhs.Data,
-				Token: condRhs,
-			},
+// inc <var>, dec <var>
+//
+// These are lowered to <var> = <var> + 1 and <var> = <var> - 1.
+func parseIncDec(c *cursor) (VarDecl, error) {
+	keyword := c.advance()
+
+	name, err := c.expect("Expected variable name", lexer.TTIdentifier)
+	if err != nil {
+		return VarDecl{}, err
+	}
+
+	op := "+"
+	if keyword.Type == lexer.TTKeywordDec {
+		op = "-"
+	}
+
+	return update(name, keyword, op, Value{Type: ValueTypeInt, Value: "1", Token: keyword}), nil
+}
+
+func update(name, token lexer.Token, op string, value Expr) VarDecl {
+	return VarDecl{
+		Name: name.Data,
+		Value: BinaryExpr{
+			Op:    op,
+			Lhs:   Value{Type: ValueTypeVar, Value: name.Data, Token: name},
+			Rhs:   value,
+			Token: token,
 		},
+		Token: name,
+	}
+}
+
+// parseCondition parses the condition of an if or while, which can be any
+// expression. Non-zero is true.
+func parseCondition(c *cursor) (Expr, error) {
+	return parseExpr(c)
+}
+
+func parseIfOrBlock(c *cursor) ([]Stmt, error) {
+	start := c.advance()
+
+	// Without a goto, the line starts a block that has to be skipped if the
+	// header is bad.
+	block := !c.lineHas(lexer.TTKeywordGoto)
+
+	cond, err := parseCondition(c)
+	if err != nil && block {
+		return nil, c.skipBlock(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	next, err := c.expect("Expected 'goto' or 'then'", lexer.TTKeywordGoto, lexer.TTKeywordThen)
+	if err != nil && block {
+		return nil, c.skipBlock(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if next.Type == lexer.TTKeywordThen {
+		return parseIfBlock(c, start, cond)
+	}
+
+	label, err := c.expectLabel()
+	if err != nil {
+		return nil, err
+	}
+
+	return []Stmt{If{
+		Cond: cond,
 		Goto: Goto{
-			Name:  gotoLabel.Data,
-			Token: gotoLabel,
+			Name:  label.Data,
+			Token: label,
 		},
-	}
+	}}, nil
 }
 
-func parseLabel(tokens []lexer.Token) Label {
-	label := tokens[0]
+func parseLabel(c *cursor) (Label, error) {
+	label := c.advance()
 
 	return Label{
-		Name: label.Data,
-	}
+		Name:  label.Data,
+		Token: label,
+	}, nil
 }
 
-func parseGoto(tokens []lexer.Token) Goto {
-	label := tokens[1]
+func parseGoto(c *cursor) (Goto, error) {
+	c.advance()
+
+	label, err := c.expectLabel()
+	if err != nil {
+		return Goto{}, err
+	}
 
 	return Goto{
 		Name:  label.Data,
 		Token: label,
-	}
+	}, nil
 }
 
-func parseCall(tokens []lexer.Token) Call {
-	name := tokens[1]
+func parseCall(c *cursor) (Call, error) {
+	c.advance()
 
-	values := []Value{}
+	name, err := c.expect("Expected function name", lexer.TTIdentifier)
+	if err != nil {
+		return Call{}, err
+	}
+
+	args := []Expr{}
 
-	index := 2
-	for tokens[index].Type != lexer.TTEndStmt {
-		values = append(values, Value{
-			Type:  valueTypeFromToken(tokens[index].Type),
-			Value: tokens[index].Data,
-			Token: tokens[index],
-		})
-		index++
+	c.args = true
+	defer func() { c.args = false }()
+
+	for c.index < len(c.tokens) && c.peek().Type != lexer.TTEndStmt {
+		arg, err := parseExpr(c)
+		if err != nil {
+			return Call{}, err
+		}
+
+		args = append(args, arg)
 	}
 
 	return Call{
-		Name:   name.Data,
-		Values: values,
-		Token:  name,
+		Name:  name.Data,
+		Args:  args,
+		Token: name,
+	}, nil
+}
+
+func single[T Stmt](stmt T, err error) ([]Stmt, error) {
+	if err != nil {
+		return nil, err
 	}
+
+	return []Stmt{stmt}, nil
 }
 
+func parseStmt(c *cursor) ([]Stmt, error) {
+	token := c.peek()
+
+	switch token.Type {
+	case lexer.TTIdentifier:
+		if c.peekAt(1).Type == lexer.TTOpAssign {
+			return single(parseVarDecl(c))
+		}
+
+		if _, ok := compoundOperators[c.peekAt(1).Type]; ok {
+			return single(parseCompoundAssign(c))
+		}
+	case lexer.TTKeywordInc, lexer.TTKeywordDec:
+		return single(parseIncDec(c))
+	case lexer.TTKeywordIf:
+		return parseIfOrBlock(c)
+	case lexer.TTLabel:
+		return single(parseLabel(c))
+	case lexer.TTKeywordGoto:
+		return single(parseGoto(c))
+	case lexer.TTKeywordCall:
+		return single(parseCall(c))
+	case lexer.TTKeywordWhile:
+		return parseWhile(c)
+	case lexer.TTKeywordFor:
+		return parseFor(c)
+	case lexer.TTKeywordBreak, lexer.TTKeywordContinue:
+		return single(parseLoopJump(c))
+	case lexer.TTKeywordFunc:
+		return single(parseFunc(c))
+	case lexer.TTKeywordReturn:
+		return single(parseReturn(c))
+	case lexer.TTKeywordGosub:
+		return single(parseGosub(c))
+	}
+
+	if lexer.IsKeyword(token.Data) && c.peekAt(1).Type == lexer.TTOpAssign {
+		return nil, reserved(token)
+	}
+
+	if _, ok := compoundOperators[c.peekAt(1).Type]; ok && lexer.IsKeyword(token.Data) {
+		return nil, reserved(token)
+	}
+
+	return nil, token.Error(STEP, "Invalid statement")
+}
+
+// parseLine parses one statement and the end of statement that follows it.
+func parseLine(c *cursor) ([]Stmt, error) {
+	stmts, err := parseStmt(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.expect("Expected end of statement", lexer.TTEndStmt); err != nil {
+		return nil, err
+	}
+
+	return stmts, nil
+}
+
+// Parse builds a program from tokens. Statements that cannot be parsed are
+// left out and reported together as lexer.Diagnostics, alongside the program
+// made of every other statement.
 func Parse(tokens []lexer.Token) (*Program, error) {
-	program := &Program{}
-	index := 0
+	return parse(tokens, 0)
+}
 
-	for index < len(tokens) {
-		if matchVarDeclValue(tokens[index:]) {
-			program.Stmts = append(program.Stmts, parseVarDeclValue(tokens[index:]))
-			index += 4
-			continue
-		} else if matchVarDeclExpr(tokens[index:]) {
-			program.Stmts = append(program.Stmts, parseVarDeclExpr(tokens[index:]))
-			index += 6
-			continue
-		} else if matchIf(tokens[index:]) {
-			program.Stmts = append(program.Stmts, parseIf(tokens[index:]))
-			index += 7
-			continue
-		} else if matchLabel(tokens[index:]) {
-			program.Stmts = append(program.Stmts, parseLabel(tokens[index:]))
-			index += 2
-			continue
-		} else if matchGoto(tokens[index:]) {
-			program.Stmts = append(program.Stmts, parseGoto(tokens[index:]))
-			index += 3
-			continue
-		} else if matchCall(tokens[index:]) {
-			stmt := parseCall(tokens[index:])
-			program.Stmts = append(program.Stmts, stmt)
-			index += 2 + len(stmt.Values)
+// Continue parses the next piece of a program that is entered a piece at a
+// time, such as in the REPL. The returned program holds only the new
+// statements, but its generated labels do not clash with those of p.
+func (p *Program) Continue(tokens []lexer.Token) (*Program, error) {
+	return parse(tokens, p.labels)
+}
+
+func parse(tokens []lexer.Token, labels int) (*Program, error) {
+	program := &Program{labels: labels}
+
+	if len(tokens) == 0 {
+		return program, nil
+	}
+
+	c := &cursor{tokens: tokens, labels: labels, funcs: map[string]bool{}}
+
+	for !c.atEnd() {
+		if c.peek().Type == lexer.TTEndStmt {
+			c.advance()
 			continue
-		} else if tokens[index].Type == lexer.TTEndStmt {
-			index++
+		}
+
+		stmts, err := parseLine(c)
+		if err != nil {
+			c.recover(err)
 			continue
 		}
 
-		return nil, tokens[index].Context.Error(STEP, "Invalid statement")
+		program.Stmts = append(program.Stmts, stmts...)
 	}
 
-	return program, nil
+	program.labels = c.labels
+
+	return program, c.diags.Err()
 }
@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+func parseSource(t *testing.T, code string) (*Program, lexer.Diagnostics) {
+	t.Helper()
+
+	tokens, err := lexer.Lex(code, "test.ez")
+	if err != nil {
+		t.Fatalf("lexing %q: %v", code, err)
+	}
+
+	program, err := Parse(tokens)
+
+	var diags lexer.Diagnostics
+	if err != nil && !errors.As(err, &diags) {
+		t.Fatalf("parsing %q: %v", code, err)
+	}
+
+	return program, diags
+}
+
+func TestRecoverSkipsBadBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		message string
+		line    int
+	}{
+		{"while", "while x > do\n  call shown 1\n  if x then\n    x = 1\n  end\nend", "Expected expression", 1},
+		{"for", "for i = 1 too 3\n  call shown i\nend", "Expected 'to'", 1},
+		{"if", "if 1 +\n  call shown 1\nend", "Expected expression", 1},
+		{"if then", "if 1 then x\n  call shown 1\nend", "Expected end of statement", 1},
+		{"else", "if 1 then\n  x = 1\nelse x\n  call shown 1\nend", "Expected end of statement", 3},
+		{"if goto", "if x == goto l\nx = 1", "Expected expression", 1},
+		{"func", "func f(\n  return 1\nend", "Expected parameter name", 1},
+		{"nested func", "func f()\n  func g()\n    return 1\n  end\n  return 2\nend", "Functions cannot be nested", 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, diags := parseSource(t, test.code+"\ncall shown 9")
+
+			if len(diags) != 1 {
+				t.Fatalf("got %d diagnostics, want 1:\n%v", len(diags), diags)
+			}
+
+			if diags[0].Message != test.message || diags[0].Context.Line != test.line {
+				t.Fatalf("got %q on line %d, want %q on line %d", diags[0].Message, diags[0].Context.Line, test.message, test.line)
+			}
+
+			last := program.Stmts[len(program.Stmts)-1]
+			if call, ok := last.(Call); !ok || call.Name != "shown" || call.Args[0].String() != "9" {
+				t.Fatalf("statement after the block was not parsed, last is %v", last)
+			}
+		})
+	}
+}
+
+func TestCallStatementArguments(t *testing.T) {
+	tests := []struct {
+		code string
+		args []string
+	}{
+		{"call f 1 -5", []string{"1", "-5"}},
+		{"call f x -1", []string{"x", "-1"}},
+		{"call f x - 1", []string{"(x - 1)"}},
+		{"call f x-1", []string{"(x - 1)"}},
+		{"call f -x -x", []string{"-x", "-x"}},
+		{"call f (x -1) -2", []string{"(x - 1)", "-2"}},
+		{"call f g(x -1)", []string{"g((x - 1))"}},
+		{"call f 2 * -3", []string{"(2 * -3)"}},
+		{"call f a (b)", []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			program, diags := parseSource(t, test.code)
+			if len(diags) > 0 {
+				t.Fatal(diags)
+			}
+
+			call := program.Stmts[0].(Call)
+
+			args := []string{}
+			for _, arg := range call.Args {
+				args = append(args, arg.String())
+			}
+
+			if strings.Join(args, ", ") != strings.Join(test.args, ", ") {
+				t.Fatalf("got arguments %q, want %q", args, test.args)
+			}
+		})
+	}
+}
+
+// Keywords cannot name variables or functions, but jumps still accept them as
+// label names.
+func TestReservedKeywords(t *testing.T) {
+	tests := []struct {
+		code    string
+		message string
+	}{
+		{"goto end\n:end", ""},
+		{"gosub do\n:do\nreturn", ""},
+		{"x = 1\nif x goto then\n:then", ""},
+		{"end = 1", "'end' is a reserved keyword"},
+		{"step += 1", "'step' is a reserved keyword"},
+		{"for to = 1 to 3\nend", "'to' is a reserved keyword"},
+		{"func do()\n  return 1\nend", "'do' is a reserved keyword"},
+		{"func f(then)\n  return 1\nend", "'then' is a reserved keyword"},
+		{"call else", "'else' is a reserved keyword"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			_, diags := parseSource(t, test.code)
+
+			if test.message == "" && len(diags) > 0 {
+				t.Fatal(diags)
+			}
+
+			if test.message != "" && (len(diags) != 1 || diags[0].Message != test.message) {
+				t.Fatalf("got %v, want %q", diags, test.message)
+			}
+		})
+	}
+}
@@ -1,16 +1,22 @@
 package parser
 
-import "github.com/vcokltfre/ez/ez/lexer"
+import (
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
 
 type StmtType string
 
 const (
-	StmtTypeVarDeclValue StmtType = "var_decl_value"
-	StmtTypeVarDeclExpr  StmtType = "var_decl_expr"
-	StmtTypeIf           StmtType = "if"
-	StmtTypeLabel        StmtType = "label"
-	StmtTypeGoto         StmtType = "goto"
-	StmtTypeCall         StmtType = "call"
+	StmtTypeVarDecl StmtType = "var_decl"
+	StmtTypeIf      StmtType = "if"
+	StmtTypeLabel   StmtType = "label"
+	StmtTypeGoto    StmtType = "goto"
+	StmtTypeCall    StmtType = "call"
+	StmtTypeFunc    StmtType = "func"
+	StmtTypeReturn  StmtType = "return"
+	StmtTypeGosub   StmtType = "gosub"
 )
 
 type ValueType string
@@ -34,38 +40,124 @@ func valueTypeFromToken(t lexer.TokenType) ValueType {
 	}
 }
 
+type ExprKind string
+
+const (
+	ExprKindValue  ExprKind = "value"
+	ExprKindUnary  ExprKind = "unary"
+	ExprKindBinary ExprKind = "binary"
+	ExprKindCall   ExprKind = "call"
+)
+
+type Expr interface {
+	Kind() ExprKind
+	Context() lexer.TokenContext
+	String() string
+}
+
 type Value struct {
 	Type  ValueType
 	Value string
 	Token lexer.Token
 }
 
-type VarDeclValue struct {
+func (v Value) Kind() ExprKind {
+	return ExprKindValue
+}
+
+func (v Value) Context() lexer.TokenContext {
+	return v.Token.Context
+}
+
+func (v Value) String() string {
+	if v.Type == ValueTypeStr {
+		return "\"" + v.Value + "\""
+	}
+
+	return v.Value
+}
+
+type UnaryExpr struct {
+	Op      string
+	Operand Expr
+	Token   lexer.Token
+}
+
+func (u UnaryExpr) Kind() ExprKind {
+	return ExprKindUnary
+}
+
+func (u UnaryExpr) Context() lexer.TokenContext {
+	return u.Token.Context
+}
+
+func (u UnaryExpr) String() string {
+	if u.Op == "not" {
+		return "not " + u.Operand.String()
+	}
+
+	return u.Op + u.Operand.String()
+}
+
+type BinaryExpr struct {
+	Op    string
+	Lhs   Expr
+	Rhs   Expr
+	Token lexer.Token
+}
+
+func (b BinaryExpr) Kind() ExprKind {
+	return ExprKindBinary
+}
+
+func (b BinaryExpr) Context() lexer.TokenContext {
+	return b.Lhs.Context()
+}
+
+func (b BinaryExpr) String() string {
+	return "(" + b.Lhs.String() + " " + b.Op + " " + b.Rhs.String() + ")"
+}
+
+type CallExpr struct {
 	Name  string
-	Value Value
+	Args  []Expr
+	Token lexer.Token
 }
 
-func (v VarDeclValue) Type() StmtType {
-	return StmtTypeVarDeclValue
+func (c CallExpr) Kind() ExprKind {
+	return ExprKindCall
 }
 
-type OpExpr struct {
-	Op  string
-	Lhs Value
-	Rhs Value
+func (c CallExpr) Context() lexer.TokenContext {
+	return c.Token.Context
 }
 
-type VarDeclExpr struct {
-	Name string
-	Expr OpExpr
+func (c CallExpr) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.String()
+	}
+
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+type VarDecl struct {
+	Name  string
+	Value Expr
+	Token lexer.Token
+
+	// Local marks a temporary introduced by lowering a block, which belongs
+	// to the scope it is in rather than being a global at the top level.
+	Local bool
 }
 
-func (v VarDeclExpr) Type() StmtType {
-	return StmtTypeVarDeclExpr
+func (v VarDecl) Type() StmtType {
+	return StmtTypeVarDecl
 }
 
+// If jumps when its condition is non-zero.
 type If struct {
-	Cond OpExpr
+	Cond Expr
 	Goto Goto
 }
 
@@ -74,7 +166,8 @@ func (i If) Type() StmtType {
 }
 
 type Label struct {
-	Name string
+	Name  string
+	Token lexer.Token
 }
 
 func (l Label) Type() StmtType {
@@ -91,19 +184,51 @@ func (g Goto) Type() StmtType {
 }
 
 type Call struct {
-	Name   string
-	Values []Value
-	Token  lexer.Token
+	Name  string
+	Args  []Expr
+	Token lexer.Token
 }
 
 func (c Call) Type() StmtType {
 	return StmtTypeCall
 }
 
+// Func is a user-defined function. Labels inside Body are local to it.
+type Func struct {
+	Name   string
+	Params []string
+	Body   []Stmt
+	Token  lexer.Token
+}
+
+func (f Func) Type() StmtType {
+	return StmtTypeFunc
+}
+
+type Return struct {
+	Value Expr
+	Token lexer.Token
+}
+
+func (r Return) Type() StmtType {
+	return StmtTypeReturn
+}
+
+type Gosub struct {
+	Name  string
+	Token lexer.Token
+}
+
+func (g Gosub) Type() StmtType {
+	return StmtTypeGosub
+}
+
 type Stmt interface {
 	Type() StmtType
 }
 
 type Program struct {
 	Stmts []Stmt
+
+	labels int
 }
@@ -0,0 +1,107 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+type Format string
+
+const (
+	FormatText  Format = "text"
+	FormatColor Format = "color"
+	FormatJSON  Format = "json"
+	FormatSARIF Format = "sarif"
+)
+
+var Formats = []Format{FormatText, FormatColor, FormatJSON, FormatSARIF}
+
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if string(format) == name {
+			return format, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown diagnostics format: %s (expected one of %v)", name, Formats)
+}
+
+// AutoFormat picks colored text for terminals and plain text otherwise, or
+// when the NO_COLOR environment variable is set.
+func AutoFormat(out *os.File) Format {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return FormatText
+	}
+
+	info, err := out.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return FormatText
+	}
+
+	return FormatColor
+}
+
+// Write renders diagnostics to w in the given format.
+func Write(w io.Writer, format Format, diags lexer.Diagnostics) error {
+	switch format {
+	case FormatText, FormatColor:
+		return writeText(w, diags, format == FormatColor)
+	case FormatJSON:
+		return writeJSON(w, diags)
+	case FormatSARIF:
+		return writeSARIF(w, diags)
+	}
+
+	return fmt.Errorf("unknown diagnostics format: %s", format)
+}
+
+func writeText(w io.Writer, diags lexer.Diagnostics, color bool) error {
+	for _, diag := range diags {
+		if _, err := fmt.Fprintf(w, "%s\n\n", diag.Format(color)); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d problem(s) found\n", len(diags))
+	return err
+}
+
+type jsonDiagnostic struct {
+	Severity lexer.Severity `json:"severity"`
+	Step     string         `json:"step"`
+	File     string         `json:"file"`
+	Line     int            `json:"line"`
+	Column   int            `json:"column"`
+	Length   int            `json:"length"`
+	Message  string         `json:"message"`
+	Tip      string         `json:"tip,omitempty"`
+	Notes    []string       `json:"notes,omitempty"`
+}
+
+// writeJSON writes one JSON object per diagnostic, each on its own line.
+func writeJSON(w io.Writer, diags lexer.Diagnostics) error {
+	encoder := json.NewEncoder(w)
+
+	for _, diag := range diags {
+		err := encoder.Encode(jsonDiagnostic{
+			Severity: diag.Severity,
+			Step:     diag.Step,
+			File:     diag.Context.File(),
+			Line:     diag.Context.Line,
+			Column:   diag.Context.Column,
+			Length:   diag.Length,
+			Message:  diag.Message,
+			Tip:      diag.Tip,
+			Notes:    diag.Notes,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package render
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// sample returns an error with a tip and a note, a warning, an error spanning
+// lines and a runtime error with no position.
+func sample(t *testing.T) lexer.Diagnostics {
+	t.Helper()
+
+	tokens, err := lexer.Lex("x = 1\ny = `a\nbc`\ncall shown z\n", "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(data string) lexer.Token {
+		for _, token := range tokens {
+			if token.Data == data {
+				return token
+			}
+		}
+
+		t.Fatalf("no token %q", data)
+		return lexer.Token{}
+	}
+
+	diags := lexer.Diagnostics{}
+
+	diags.Add(find("z").Error("checking", "variable does not exist", "Assign it first"))
+	diags[0].Notes = []string{"note: z is read here"}
+
+	diags.Add(find("x").Warning("checking", "variable is never read"))
+	diags.Add(find("a\nbc").Error("parsing", "unexpected string literal"))
+	diags.Add(errors.New("boom"))
+
+	diags.Sort()
+
+	return diags
+}
+
+func TestGolden(t *testing.T) {
+	for _, format := range []Format{FormatText, FormatJSON, FormatSARIF} {
+		t.Run(string(format), func(t *testing.T) {
+			var out strings.Builder
+			if err := Write(&out, format, sample(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", string(format)+".golden")
+
+			if *update {
+				if err := os.WriteFile(path, []byte(out.String()), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if out.String() != string(want) {
+				t.Fatalf("output differs from %s:\n%s", path, out.String())
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, format := range Formats {
+		if got, err := ParseFormat(string(format)); err != nil || got != format {
+			t.Errorf("ParseFormat(%q) = %q, %v", format, got, err)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("parsed an unknown format")
+	}
+}
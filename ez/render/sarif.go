@@ -0,0 +1,157 @@
+package render
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+// The subset of SARIF 2.1.0 needed to upload diagnostics to code scanning.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// sarifSpan returns the region a diagnostic covers, which ends on a later line
+// when it spans a raw string or a block comment.
+func sarifSpan(diag lexer.Diagnostic) sarifRegion {
+	region := sarifRegion{
+		StartLine:   diag.Context.Line,
+		StartColumn: diag.Context.Column,
+		EndLine:     diag.Context.Line,
+		EndColumn:   diag.Context.Column + max(diag.Length, 1),
+	}
+
+	if diag.Context.Source == nil {
+		return region
+	}
+
+	code := diag.Context.Source.Code
+	start := min(diag.Context.Index, len(code))
+	text := code[start:min(start+diag.Length, len(code))]
+
+	if lines := strings.Count(text, "\n"); lines > 0 {
+		region.EndLine += lines
+		region.EndColumn = len(text) - strings.LastIndexByte(text, '\n')
+	}
+
+	return region
+}
+
+func sarifLevel(severity lexer.Severity) string {
+	if severity == lexer.SeverityWarning {
+		return "warning"
+	}
+
+	return "error"
+}
+
+func writeSARIF(w io.Writer, diags lexer.Diagnostics) error {
+	rules := []sarifRule{}
+	seen := map[string]bool{}
+	results := []sarifResult{}
+
+	for _, diag := range diags {
+		rule := "ez/" + diag.Step
+		if !seen[rule] {
+			seen[rule] = true
+			rules = append(rules, sarifRule{
+				ID:               rule,
+				ShortDescription: sarifMessage{Text: "Problem found during " + diag.Step},
+			})
+		}
+
+		message := diag.Message
+		if diag.Tip != "" {
+			message += " (" + diag.Tip + ")"
+		}
+
+		result := sarifResult{
+			RuleID:  rule,
+			Level:   sarifLevel(diag.Severity),
+			Message: sarifMessage{Text: message},
+		}
+
+		if diag.Context.Line > 0 {
+			result.Locations = []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: strings.TrimPrefix(diag.Context.File(), "./")},
+					Region:           sarifSpan(diag),
+				},
+			}}
+		}
+
+		results = append(results, result)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "ez",
+				InformationURI: "https://github.com/vcokltfre/ez",
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	})
+}
@@ -0,0 +1,349 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+	"github.com/vcokltfre/ez/ez/render"
+	"github.com/vcokltfre/ez/ez/vm"
+)
+
+const (
+	prompt       = "ez> "
+	continuation = "... "
+	sourceName   = "<repl>"
+)
+
+const help = `Enter ez statements to run them. Blocks run once their 'end' is entered.
+Labels and functions defined earlier in the session stay defined.
+
+  :vars [all]       show variables (all includes generated ones)
+  :mem <addr> <len> show memory cells
+  :funcs            show builtins and functions
+  :reset            clear all variables, memory, labels and functions
+  :load <file>      run a file as part of the session
+  :help             show this message
+  :quit             leave the REPL
+
+A line starting with one of these names runs the command, so labels named
+:vars, :mem, :funcs, :reset, :load, :help, :quit and :exit can only be
+defined inside a block.
+`
+
+// Session is an interactive ez session. Everything entered is kept as one
+// program so later input can jump to labels and call functions defined
+// earlier, while only the new statements run.
+type Session struct {
+	Memory   int
+	MaxDepth int
+	Format   render.Format
+
+	// in is shared with the programs run, so input they read is the input that
+	// follows the line that ran them.
+	in  *bufio.Reader
+	out io.Writer
+
+	executor *vm.VM
+	stmts    []parser.Stmt
+	last     *parser.Program
+}
+
+func New(in io.Reader, out io.Writer, memory, maxDepth int, format render.Format) *Session {
+	s := &Session{
+		Memory:   memory,
+		MaxDepth: maxDepth,
+		Format:   format,
+		in:       bufio.NewReader(in),
+		out:      out,
+	}
+	s.reset()
+
+	return s
+}
+
+func (s *Session) reset() {
+	s.executor = vm.New(s.Memory)
+	s.executor.MaxDepth = s.MaxDepth
+	s.executor.Stdin = s.in
+	s.executor.Stdout = s.out
+	s.executor.Grant(vm.Unrestricted())
+	s.stmts = nil
+	s.last = &parser.Program{}
+}
+
+// Run reads input until EOF or :quit.
+func (s *Session) Run() error {
+	fmt.Fprintln(s.out, "ez REPL, :help for help")
+
+	buffer := ""
+
+	for {
+		if buffer == "" {
+			fmt.Fprint(s.out, prompt)
+		} else {
+			fmt.Fprint(s.out, continuation)
+		}
+
+		line, err := s.readLine()
+		if err == io.EOF {
+			fmt.Fprintln(s.out)
+			return nil
+		} else if err != nil {
+			fmt.Fprintln(s.out)
+			return err
+		}
+
+		if buffer == "" && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			quit, handled := s.command(strings.Fields(strings.TrimSpace(line)[1:]))
+			if quit {
+				return nil
+			}
+			if handled {
+				continue
+			}
+		}
+
+		buffer += line + "\n"
+
+		tokens, err := lexer.Lex(buffer, sourceName)
+		if err == nil && depth(tokens) > 0 {
+			continue
+		}
+
+		s.run(buffer, sourceName, true)
+		buffer = ""
+	}
+}
+
+// readLine reads a line of input without its line ending. The last line may
+// end without one.
+func (s *Session) readLine() (string, error) {
+	line, err := s.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), err
+}
+
+// depth returns how many blocks are still open at the end of the tokens.
+func depth(tokens []lexer.Token) int {
+	open := 0
+	start := true
+
+	for _, token := range tokens {
+		if token.Type == lexer.TTEndStmt {
+			start = true
+			continue
+		}
+
+		switch {
+		case start && (token.Type == lexer.TTKeywordWhile || token.Type == lexer.TTKeywordFor || token.Type == lexer.TTKeywordFunc):
+			open++
+		case token.Type == lexer.TTKeywordThen:
+			open++
+		case start && token.Type == lexer.TTKeywordEnd:
+			open--
+		}
+
+		start = false
+	}
+
+	return open
+}
+
+// command runs a meta-command. Lines that are not a known command are left to
+// the parser, so other labels can still be defined with the same syntax.
+func (s *Session) command(fields []string) (quit bool, handled bool) {
+	if len(fields) == 0 {
+		return false, false
+	}
+
+	switch fields[0] {
+	case "quit", "exit":
+		return true, true
+	case "help":
+		fmt.Fprint(s.out, help)
+	case "vars":
+		s.vars(len(fields) > 1 && fields[1] == "all")
+	case "mem":
+		s.mem(fields[1:])
+	case "funcs":
+		s.funcs()
+	case "reset":
+		s.reset()
+		fmt.Fprintln(s.out, "session reset")
+	case "load":
+		if len(fields) != 2 {
+			fmt.Fprintln(s.out, "usage: :load <file>")
+			break
+		}
+
+		data, err := os.ReadFile(fields[1])
+		if err != nil {
+			fmt.Fprintln(s.out, err)
+			break
+		}
+
+		s.run(string(data), fields[1], false)
+	default:
+		return false, false
+	}
+
+	return false, true
+}
+
+func (s *Session) vars(all bool) {
+	for _, name := range s.executor.Variables.Names() {
+		if !all && strings.HasPrefix(name, "__") {
+			continue
+		}
+
+		val, _ := s.executor.Variables.Get(name)
+		fmt.Fprintf(s.out, "%s = %d\n", name, val)
+	}
+}
+
+func (s *Session) mem(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(s.out, "usage: :mem <addr> <len>")
+		return
+	}
+
+	addr, err := strconv.ParseInt(args[0], 0, 64)
+	if err != nil {
+		fmt.Fprintln(s.out, "invalid address:", args[0])
+		return
+	}
+
+	length, err := strconv.ParseInt(args[1], 0, 64)
+	if err != nil || length < 0 {
+		fmt.Fprintln(s.out, "invalid length:", args[1])
+		return
+	}
+
+	size := int64(len(s.executor.Memory))
+	if addr < 0 || addr >= size {
+		fmt.Fprintf(s.out, "address out of range (memory has %d cells)\n", size)
+		return
+	}
+
+	end := min(addr+length, size)
+
+	for row := addr; row < end; row += 8 {
+		fmt.Fprintf(s.out, "%6d:", row)
+
+		for i := row; i < min(row+8, end); i++ {
+			fmt.Fprintf(s.out, " %d", s.executor.Memory[i])
+		}
+
+		fmt.Fprintln(s.out)
+	}
+}
+
+func (s *Session) funcs() {
+	names := []string{}
+	for name := range s.executor.Funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(s.out, "builtins:")
+	for _, name := range names {
+		fmt.Fprintf(s.out, "  %s %s\n", name, s.executor.Funcs[name].Signature)
+	}
+
+	fmt.Fprintln(s.out, "functions:")
+	for _, stmt := range s.stmts {
+		if fn, ok := stmt.(parser.Func); ok {
+			fmt.Fprintf(s.out, "  %s(%s)\n", fn.Name, strings.Join(fn.Params, ", "))
+		}
+	}
+}
+
+// run parses code as the next piece of the session and runs its statements.
+// A single assignment echoes the assigned value.
+func (s *Session) run(code, filename string, echo bool) {
+	diags := lexer.Diagnostics{}
+
+	tokens, err := lexer.Lex(code, filename)
+	if err != nil {
+		diags.Add(err)
+	}
+
+	program, err := s.last.Continue(tokens)
+	if err != nil {
+		diags.Add(err)
+	}
+	s.last = program
+
+	if diags.HasErrors() {
+		diags.Sort()
+		s.report(diags)
+		return
+	}
+
+	// Redefining a function replaces the earlier definition.
+	for _, stmt := range program.Stmts {
+		if fn, ok := stmt.(parser.Func); ok {
+			s.stmts = removeFunc(s.stmts, fn.Name)
+		}
+	}
+
+	start := len(s.stmts)
+	s.stmts = append(s.stmts, program.Stmts...)
+
+	if start == len(s.stmts) {
+		return
+	}
+
+	compiled := vm.Compile(&parser.Program{Stmts: s.stmts}, s.executor.Funcs)
+
+	if err := s.executor.ExecFrom(compiled, compiled.Starts[start]); err != nil {
+		fmt.Fprintln(s.out)
+		s.report(err)
+		return
+	}
+
+	if decl, ok := program.Stmts[0].(parser.VarDecl); ok && echo && len(program.Stmts) == 1 {
+		val, _ := s.executor.Variables.Get(decl.Name)
+		fmt.Fprintf(s.out, "%s = %d\n", decl.Name, val)
+	}
+}
+
+func (s *Session) report(err error) {
+	diags := lexer.Diagnostics{}
+	diags.Add(err)
+
+	for _, diag := range diags {
+		if s.Format == render.FormatText || s.Format == render.FormatColor {
+			fmt.Fprintf(s.out, "%s\n", diag.Format(s.Format == render.FormatColor))
+			continue
+		}
+
+		if err := render.Write(s.out, s.Format, lexer.Diagnostics{diag}); err != nil {
+			fmt.Fprintln(s.out, err)
+		}
+	}
+}
+
+func removeFunc(stmts []parser.Stmt, name string) []parser.Stmt {
+	kept := stmts[:0]
+
+	for _, stmt := range stmts {
+		if fn, ok := stmt.(parser.Func); ok && fn.Name == name {
+			continue
+		}
+
+		kept = append(kept, stmt)
+	}
+
+	return kept
+}
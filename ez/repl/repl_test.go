@@ -0,0 +1,51 @@
+package repl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/render"
+)
+
+func run(t *testing.T, input string) string {
+	t.Helper()
+
+	var out strings.Builder
+
+	session := New(strings.NewReader(input), &out, 64, 100, render.FormatText)
+	if err := session.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"echo", "x = 4\n", "x = 4"},
+		{"input follows the line", "call input a\nZ\ncall shown a\n", "90"},
+		{"end of input", "call input a", "ez> "},
+		{"block", "for i = 1 to 3\ncall shown i\nend\n", "123"},
+		{"command", ":help\n", "leave the REPL"},
+		{"unterminated last line", "call shown 7", "7"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := run(t, test.input); !strings.Contains(got, test.want) {
+				t.Fatalf("output %q does not contain %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLabelNamedLikeCommand(t *testing.T) {
+	got := run(t, "x = 0\nwhile x < 1 do\n:vars\nx = x + 1\nend\nif x < 2 goto vars\ncall shown x\n")
+	if strings.Contains(got, "error") || !strings.Contains(got, "2") {
+		t.Fatalf("label in a block was not defined:\n%s", got)
+	}
+}
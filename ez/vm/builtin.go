@@ -0,0 +1,289 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+)
+
+// ParamKind says what a builtin accepts for a parameter and how the VM passes
+// it on.
+type ParamKind int
+
+const (
+	ParamInt    ParamKind = iota // any expression, passed as its value
+	ParamVar                     // a variable name, passed as a Ref to write to
+	ParamString                  // a string literal, passed as its text
+	ParamValue                   // a string literal or any expression
+)
+
+// Param is one parameter of a builtin. An optional parameter may be left out
+// along with all the ones after it, and a variadic one takes the rest of the
+// arguments, so only the last parameters can be either.
+type Param struct {
+	Name     string
+	Kind     ParamKind
+	Optional bool
+	Variadic bool
+}
+
+func In(name string) Param {
+	return Param{Name: name, Kind: ParamInt}
+}
+
+func Out(name string) Param {
+	return Param{Name: name, Kind: ParamVar}
+}
+
+func Str(name string) Param {
+	return Param{Name: name, Kind: ParamString}
+}
+
+func Any(name string) Param {
+	return Param{Name: name, Kind: ParamValue}
+}
+
+// Opt returns the parameter made optional.
+func (p Param) Opt() Param {
+	p.Optional = true
+	return p
+}
+
+// Many returns the parameter made variadic.
+func (p Param) Many() Param {
+	p.Variadic = true
+	return p
+}
+
+func (p Param) String() string {
+	s := "<" + p.Name + ">"
+	if p.Kind == ParamString {
+		s = `"` + p.Name + `"`
+	}
+
+	if p.Variadic {
+		s += "..."
+	}
+
+	if p.Optional {
+		s = "[" + s + "]"
+	}
+
+	return s
+}
+
+// Signature lists the parameters of a builtin.
+type Signature []Param
+
+// Arity returns the least and most arguments the signature accepts, the most
+// being -1 if there is no limit.
+func (s Signature) Arity() (int, int) {
+	least := 0
+	for _, param := range s {
+		if param.Optional || param.Variadic {
+			break
+		}
+
+		least++
+	}
+
+	if len(s) > 0 && s[len(s)-1].Variadic {
+		return least, -1
+	}
+
+	return least, len(s)
+}
+
+// Accepts reports whether the signature takes n arguments.
+func (s Signature) Accepts(n int) bool {
+	least, most := s.Arity()
+	return n >= least && (most == -1 || n <= most)
+}
+
+// Expected describes the number of arguments the signature takes.
+func (s Signature) Expected() string {
+	least, most := s.Arity()
+
+	switch {
+	case most == -1:
+		return fmt.Sprintf("at least %d", least)
+	case least == most:
+		return fmt.Sprint(least)
+	}
+
+	return fmt.Sprintf("%d to %d", least, most)
+}
+
+// Param returns the parameter that argument i is passed to.
+func (s Signature) Param(i int) (Param, bool) {
+	if i < len(s) {
+		return s[i], true
+	}
+
+	if len(s) > 0 && s[len(s)-1].Variadic {
+		return s[len(s)-1], true
+	}
+
+	return Param{}, false
+}
+
+func (s Signature) String() string {
+	params := make([]string, len(s))
+	for i, param := range s {
+		params[i] = param.String()
+	}
+
+	return strings.Join(params, " ")
+}
+
+// Check returns the error for an argument that does not fit its parameter,
+// other than a variable that does not exist, reported during step.
+func (p Param) Check(step string, arg parser.Expr) error {
+	val, isValue := arg.(parser.Value)
+
+	switch p.Kind {
+	case ParamVar:
+		if !isValue || val.Type != parser.ValueTypeVar {
+			return arg.Context().Error(step, "expected identifier", fmt.Sprintf("%s is written to, so it must be a variable", p.Name))
+		}
+	case ParamString:
+		if !isValue || val.Type != parser.ValueTypeStr {
+			return arg.Context().Error(step, "expected string literal")
+		}
+	case ParamInt:
+		if isValue && val.Type == parser.ValueTypeStr {
+			return arg.Context().Error(step, "unexpected string literal", "Strings can only be passed where a builtin asks for one")
+		}
+	}
+
+	return nil
+}
+
+// Ref is a variable a builtin writes to. It refers to the slot of the
+// variable in the scope of the call, so it is only valid until the builtin
+// returns.
+type Ref struct {
+	vm    *VM
+	Name  string
+	slot  int
+	local bool
+}
+
+func (r Ref) Get() (int64, bool) {
+	if r.local {
+		return r.vm.locals[r.slot], r.vm.defined[r.slot]
+	}
+
+	return r.vm.Variables.values[r.slot], r.vm.Variables.defined[r.slot]
+}
+
+func (r Ref) Set(val int64) {
+	if r.local {
+		r.vm.locals[r.slot] = val
+		r.vm.defined[r.slot] = true
+		return
+	}
+
+	r.vm.Variables.values[r.slot] = val
+	r.vm.Variables.define(r.slot)
+}
+
+// Arg is an argument resolved for its parameter: Int for ParamInt, String for
+// ParamString, Var for ParamVar, and either Int or String for ParamValue.
+type Arg struct {
+	Int    int64
+	String string
+	Var    Ref
+
+	// IsString is set when the argument is a string literal.
+	IsString bool
+
+	Expr parser.Expr
+}
+
+// Context returns the position of the argument in the source.
+func (a Arg) Context() lexer.TokenContext {
+	return a.Expr.Context()
+}
+
+// Builtin is a host function called with arguments already resolved against
+// its signature. Optional arguments that were left out are not in args.
+type Builtin func(ctx lexer.TokenContext, args []Arg) error
+
+type ExternalFunc struct {
+	Signature Signature
+	Fn        Builtin
+}
+
+func (vm *VM) RegisterFunc(name string, sig Signature, fn Builtin) {
+	vm.Funcs[name] = ExternalFunc{
+		Signature: sig,
+		Fn:        fn,
+	}
+}
+
+// Check returns the error for a call whose arguments do not fit the
+// signature, reported during step.
+func (s Signature) Check(step string, call parser.Call) error {
+	if !s.Accepts(len(call.Args)) {
+		return call.Token.Error(step, fmt.Sprintf("incorrect number of arguments (expected %s, got %d)", s.Expected(), len(call.Args)))
+	}
+
+	for i, expr := range call.Args {
+		param, _ := s.Param(i)
+		if err := param.Check(step, expr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// equal reports whether two signatures pass arguments the same way.
+func (s Signature) equal(other Signature) bool {
+	if len(s) != len(other) {
+		return false
+	}
+
+	for i := range s {
+		if s[i].Kind != other[i].Kind || s[i].Optional != other[i].Optional || s[i].Variadic != other[i].Variadic {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolve builds the arguments of a compiled call, popping the values of its
+// expression arguments off the stack.
+func (vm *VM) resolve(call BuiltinCall) []Arg {
+	stacked := 0
+	for _, arg := range call.Args {
+		if arg.Stacked {
+			stacked++
+		}
+	}
+
+	values := vm.stack[len(vm.stack)-stacked:]
+	vm.stack = vm.stack[:len(vm.stack)-stacked]
+
+	args := make([]Arg, len(call.Args))
+	for i, arg := range call.Args {
+		args[i].Expr = arg.Expr
+
+		switch {
+		case arg.Stacked:
+			args[i].Int = values[0]
+			values = values[1:]
+		case arg.IsString:
+			args[i].String = arg.String
+			args[i].IsString = true
+		default:
+			args[i].Var = Ref{vm: vm, Name: arg.Expr.(parser.Value).Value, slot: arg.Slot, local: arg.Local}
+		}
+	}
+
+	return args
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+)
+
+type Opcode uint8
+
+const (
+	OpConst       Opcode = iota // push Arg
+	OpLoadGlobal                // push global slot Arg
+	OpLoadLocal                 // push local slot Arg
+	OpStoreGlobal               // pop into global slot Arg
+	OpStoreLocal                // pop into local slot Arg
+	OpPop                       // discard the top of the stack
+	OpIncGlobal                 // pop and add to global slot Arg
+	OpIncLocal                  // pop and add to local slot Arg
+
+	OpNeg
+	OpBitNot
+	OpNot // 1 if the top of the stack is zero, else 0
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpPow
+	OpAnd
+	OpOr
+	OpXor
+	OpShl
+	OpShr  // arithmetic shift right
+	OpUshr // logical shift right
+
+	OpEq
+	OpNe
+	OpLt
+	OpGt
+	OpLe
+	OpGe
+
+	OpJump     // jump to Arg
+	OpJumpTrue // pop, jump to Arg if non-zero
+	OpCall     // call function Arg with its arguments on the stack
+	OpReturn   // pop the return value and return to the caller
+	OpGosub    // push a gosub frame and jump to Arg
+	OpBuiltin  // run builtin call Arg
+	OpNoFunc   // report that the function in call Arg cannot be used as a value
+	OpFail     // runtime error with message Arg
+	OpHalt
+)
+
+type Instr struct {
+	Op  Opcode
+	Arg int64
+}
+
+// Function is a compiled user-defined function. Its locals are addressed by
+// slot, with the parameters occupying the first slots.
+type Function struct {
+	Name   string
+	Params int
+	Entry  int
+	Locals []string
+
+	slots map[string]int
+
+	// counted is the number of locals that count towards VM.MaxVariables.
+	counted int
+}
+
+// BuiltinCall is a call to a host function, compiled against its signature.
+// The values of arguments that are expressions are pushed before the call, in
+// order. Err, if set, is the error the call fails with because its arguments
+// do not fit the signature.
+type BuiltinCall struct {
+	Name      string
+	Args      []BuiltinArg
+	Token     lexer.Token
+	Signature Signature
+	Err       error
+}
+
+// BuiltinArg is an argument of a builtin call: a value on the stack, a string
+// literal, or a variable to write to, addressed by slot.
+type BuiltinArg struct {
+	Expr parser.Expr
+
+	Stacked  bool
+	IsString bool
+	String   string
+
+	Slot  int
+	Local bool
+}
+
+// Code is a compiled program. It is not modified by execution. Contexts holds
+// the source position of each instruction for error reporting and Stmts marks
+// the instructions that begin a statement. Labels has the label names by
+// instruction offset, and Starts the instruction offset of each top-level
+// statement. Main holds the locals of the top level, which are only the
+// temporaries of lowered blocks; its other variables are globals.
+type Code struct {
+	Instrs   []Instr
+	Contexts []lexer.TokenContext
+	Stmts    []bool
+	Labels   map[int]string
+	Starts   []int
+	Globals  []string
+	Funcs    []*Function
+	Main     *Function
+	Calls    []BuiltinCall
+	Messages []string
+}
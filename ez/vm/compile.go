@@ -0,0 +1,508 @@
+package vm
+
+import (
+	"strconv"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+)
+
+var binaryOps = map[string]Opcode{
+	"+":   OpAdd,
+	"-":   OpSub,
+	"*":   OpMul,
+	"/":   OpDiv,
+	"%":   OpMod,
+	"^":   OpPow,
+	"&":   OpAnd,
+	"|":   OpOr,
+	"xor": OpXor,
+	"<<":  OpShl,
+	">>":  OpShr,
+	">>>": OpUshr,
+	"==":  OpEq,
+	"!=":  OpNe,
+	"<":   OpLt,
+	">":   OpGt,
+	"<=":  OpLe,
+	">=":  OpGe,
+}
+
+type fixup struct {
+	instr int
+	label string
+}
+
+type compiler struct {
+	code     *Code
+	globals  map[string]int
+	funcs    map[string]int
+	builtins map[string]ExternalFunc
+
+	fn     *Function
+	labels map[string]int
+	fixups []fixup
+}
+
+func (c *compiler) emit(op Opcode, arg int64, ctx lexer.TokenContext) int {
+	c.code.Instrs = append(c.code.Instrs, Instr{Op: op, Arg: arg})
+	c.code.Contexts = append(c.code.Contexts, ctx)
+	c.code.Stmts = append(c.code.Stmts, false)
+
+	return len(c.code.Instrs) - 1
+}
+
+func (c *compiler) fail(message string, ctx lexer.TokenContext) {
+	c.code.Messages = append(c.code.Messages, message)
+	c.emit(OpFail, int64(len(c.code.Messages)-1), ctx)
+}
+
+func (c *compiler) jump(op Opcode, label string, ctx lexer.TokenContext) {
+	c.fixups = append(c.fixups, fixup{
+		instr: c.emit(op, 0, ctx),
+		label: label,
+	})
+}
+
+func (c *compiler) global(name string) int64 {
+	slot, ok := c.globals[name]
+	if !ok {
+		slot = len(c.code.Globals)
+		c.globals[name] = slot
+		c.code.Globals = append(c.code.Globals, name)
+	}
+
+	return int64(slot)
+}
+
+// slot returns the slot of a variable and whether it is a local.
+func (c *compiler) slot(name string) (int, bool) {
+	if c.fn != nil {
+		if slot, ok := c.fn.slots[name]; ok {
+			return slot, true
+		}
+	}
+
+	return int(c.global(name)), false
+}
+
+func (c *compiler) load(name string, ctx lexer.TokenContext) {
+	if c.fn != nil {
+		if slot, ok := c.fn.slots[name]; ok {
+			c.emit(OpLoadLocal, int64(slot), ctx)
+			return
+		}
+	}
+
+	c.emit(OpLoadGlobal, c.global(name), ctx)
+}
+
+func (c *compiler) store(name string, ctx lexer.TokenContext) {
+	if c.fn != nil {
+		if slot, ok := c.fn.slots[name]; ok {
+			c.emit(OpStoreLocal, int64(slot), ctx)
+			return
+		}
+	}
+
+	c.emit(OpStoreGlobal, c.global(name), ctx)
+}
+
+// increment compiles x = x + y and x = x - y, which is what +=, -=, inc and
+// dec lower to, as an in-place update when y is a literal or a variable. Other
+// operands could change x before it is read, so they are left to compileExpr.
+func (c *compiler) increment(decl parser.VarDecl) bool {
+	binary, ok := decl.Value.(parser.BinaryExpr)
+	if !ok || binary.Op != "+" && binary.Op != "-" {
+		return false
+	}
+
+	lhs, ok := binary.Lhs.(parser.Value)
+	if !ok || lhs.Type != parser.ValueTypeVar || lhs.Value != decl.Name {
+		return false
+	}
+
+	rhs, ok := binary.Rhs.(parser.Value)
+	if !ok || rhs.Type == parser.ValueTypeStr {
+		return false
+	}
+
+	c.compileExpr(rhs)
+	if binary.Op == "-" {
+		c.emit(OpNeg, 0, binary.Token.Context)
+	}
+
+	if c.fn != nil {
+		if slot, ok := c.fn.slots[decl.Name]; ok {
+			c.emit(OpIncLocal, int64(slot), lhs.Token.Context)
+			return true
+		}
+	}
+
+	c.emit(OpIncGlobal, c.global(decl.Name), lhs.Token.Context)
+
+	return true
+}
+
+func (c *compiler) compileExpr(expr parser.Expr) {
+	switch expr.Kind() {
+	case parser.ExprKindValue:
+		val := expr.(parser.Value)
+
+		switch val.Type {
+		case parser.ValueTypeInt:
+			num, err := strconv.ParseInt(val.Value, 10, 64)
+			if err != nil {
+				c.fail("integer literal out of range", val.Token.Context)
+				return
+			}
+
+			c.emit(OpConst, num, val.Token.Context)
+		case parser.ValueTypeVar:
+			c.load(val.Value, val.Token.Context)
+		default:
+			c.fail("expected identifier or literal int not literal str", val.Token.Context)
+		}
+	case parser.ExprKindUnary:
+		unary := expr.(parser.UnaryExpr)
+
+		c.compileExpr(unary.Operand)
+
+		switch unary.Op {
+		case "-":
+			c.emit(OpNeg, 0, unary.Token.Context)
+		case "~":
+			c.emit(OpBitNot, 0, unary.Token.Context)
+		case "not":
+			c.emit(OpNot, 0, unary.Token.Context)
+		default:
+			c.fail("unsupported operator: "+unary.Op, unary.Token.Context)
+		}
+	case parser.ExprKindBinary:
+		binary := expr.(parser.BinaryExpr)
+
+		if binary.Op == "and" || binary.Op == "or" {
+			c.compileLogical(binary)
+			return
+		}
+
+		c.compileExpr(binary.Lhs)
+		c.compileExpr(binary.Rhs)
+
+		op, ok := binaryOps[binary.Op]
+		if !ok {
+			c.fail("unsupported operator: "+binary.Op, binary.Token.Context)
+			return
+		}
+
+		c.emit(op, 0, binary.Token.Context)
+	case parser.ExprKindCall:
+		call := expr.(parser.CallExpr)
+
+		index, ok := c.funcs[call.Name]
+		if !ok {
+			c.code.Calls = append(c.code.Calls, BuiltinCall{Name: call.Name, Token: call.Token})
+			c.emit(OpNoFunc, int64(len(c.code.Calls)-1), call.Token.Context)
+			return
+		}
+
+		c.compileCall(index, call.Args, call.Token.Context)
+	}
+}
+
+// compileLogical compiles and/or so the right hand side is only evaluated when
+// the left does not decide the result. The result is 0 or 1.
+//
+//	a and b: a; jumptrue rhs; const 0; jump end; rhs: b; not; not; end:
+//	a or b:  a; jumptrue one; b; not; not; jump end; one: const 1; end:
+func (c *compiler) compileLogical(binary parser.BinaryExpr) {
+	ctx := binary.Token.Context
+
+	c.compileExpr(binary.Lhs)
+	decided := c.emit(OpJumpTrue, 0, ctx)
+
+	if binary.Op == "and" {
+		c.emit(OpConst, 0, ctx)
+		end := c.emit(OpJump, 0, ctx)
+
+		c.code.Instrs[decided].Arg = int64(len(c.code.Instrs))
+		c.compileExpr(binary.Rhs)
+		c.emit(OpNot, 0, ctx)
+		c.emit(OpNot, 0, ctx)
+
+		c.code.Instrs[end].Arg = int64(len(c.code.Instrs))
+		return
+	}
+
+	c.compileExpr(binary.Rhs)
+	c.emit(OpNot, 0, ctx)
+	c.emit(OpNot, 0, ctx)
+	end := c.emit(OpJump, 0, ctx)
+
+	c.code.Instrs[decided].Arg = int64(len(c.code.Instrs))
+	c.emit(OpConst, 1, ctx)
+
+	c.code.Instrs[end].Arg = int64(len(c.code.Instrs))
+}
+
+func (c *compiler) compileCall(index int, args []parser.Expr, ctx lexer.TokenContext) {
+	fn := c.code.Funcs[index]
+
+	if len(args) != fn.Params {
+		c.fail("incorrect number of arguments (expected "+strconv.Itoa(fn.Params)+", got "+strconv.Itoa(len(args))+")", ctx)
+		return
+	}
+
+	for _, arg := range args {
+		c.compileExpr(arg)
+	}
+
+	c.emit(OpCall, int64(index), ctx)
+}
+
+// compileBuiltin compiles a call statement to a host function, pushing the
+// values of its expression arguments and resolving its output variables to
+// slots. Arguments that do not fit the signature fail when the call is reached.
+func (c *compiler) compileBuiltin(call parser.Call) {
+	builtin := BuiltinCall{Name: call.Name, Token: call.Token}
+
+	if fn, ok := c.builtins[call.Name]; ok {
+		builtin.Signature = fn.Signature
+		builtin.Err = fn.Signature.Check("runtime", call)
+	} else {
+		builtin.Err = call.Token.Error("runtime", "builtin was not registered when the program was compiled")
+	}
+
+	if builtin.Err == nil {
+		builtin.Args = make([]BuiltinArg, len(call.Args))
+
+		for i, expr := range call.Args {
+			param, _ := builtin.Signature.Param(i)
+			arg := &builtin.Args[i]
+			arg.Expr = expr
+
+			if val, ok := expr.(parser.Value); ok && val.Type == parser.ValueTypeStr {
+				arg.IsString = true
+				arg.String = val.Value
+			} else if param.Kind == ParamVar {
+				arg.Slot, arg.Local = c.slot(expr.(parser.Value).Value)
+			} else {
+				c.compileExpr(expr)
+				arg.Stacked = true
+			}
+		}
+	}
+
+	c.code.Calls = append(c.code.Calls, builtin)
+	c.emit(OpBuiltin, int64(len(c.code.Calls)-1), call.Token.Context)
+}
+
+func (c *compiler) compileStmt(stmt parser.Stmt) {
+	switch stmt.Type() {
+	case parser.StmtTypeVarDecl:
+		decl := stmt.(parser.VarDecl)
+
+		if c.increment(decl) {
+			return
+		}
+
+		c.compileExpr(decl.Value)
+		c.store(decl.Name, decl.Token.Context)
+	case parser.StmtTypeIf:
+		ifStmt := stmt.(parser.If)
+
+		c.compileExpr(ifStmt.Cond)
+		c.jump(OpJumpTrue, ifStmt.Goto.Name, ifStmt.Goto.Token.Context)
+	case parser.StmtTypeLabel:
+		name := stmt.(parser.Label).Name
+
+		c.labels[name] = len(c.code.Instrs)
+		c.code.Labels[len(c.code.Instrs)] = name
+	case parser.StmtTypeGoto:
+		goTo := stmt.(parser.Goto)
+
+		c.jump(OpJump, goTo.Name, goTo.Token.Context)
+	case parser.StmtTypeCall:
+		call := stmt.(parser.Call)
+
+		if index, ok := c.funcs[call.Name]; ok {
+			c.compileCall(index, call.Args, call.Token.Context)
+			c.emit(OpPop, 0, call.Token.Context)
+			return
+		}
+
+		c.compileBuiltin(call)
+	case parser.StmtTypeFunc:
+	case parser.StmtTypeReturn:
+		ret := stmt.(parser.Return)
+
+		c.compileExpr(ret.Value)
+		c.emit(OpReturn, 0, ret.Token.Context)
+	case parser.StmtTypeGosub:
+		gosub := stmt.(parser.Gosub)
+
+		c.jump(OpGosub, gosub.Name, gosub.Token.Context)
+	}
+}
+
+// compileScope compiles a top-level or function body and resolves the jumps in
+// it. Jumps to labels that do not exist fail when they are reached.
+func (c *compiler) compileScope(stmts []parser.Stmt) {
+	c.labels = map[string]int{}
+	c.fixups = nil
+
+	for _, stmt := range stmts {
+		start := len(c.code.Instrs)
+
+		if c.fn == c.code.Main {
+			c.code.Starts = append(c.code.Starts, start)
+		}
+
+		c.compileStmt(stmt)
+
+		if len(c.code.Instrs) > start {
+			c.code.Stmts[start] = true
+		}
+	}
+
+	for _, f := range c.fixups {
+		target, ok := c.labels[f.label]
+		if !ok {
+			c.code.Messages = append(c.code.Messages, "label does not exist")
+			c.code.Instrs[f.instr] = Instr{Op: OpFail, Arg: int64(len(c.code.Messages) - 1)}
+			continue
+		}
+
+		c.code.Instrs[f.instr].Arg = int64(target)
+	}
+}
+
+// outputs returns the variables a call statement passes to the output
+// parameters of a builtin.
+func (c *compiler) outputs(call parser.Call) []string {
+	if _, ok := c.funcs[call.Name]; ok {
+		return nil
+	}
+
+	names := []string{}
+	for i, arg := range call.Args {
+		param, _ := c.builtins[call.Name].Signature.Param(i)
+		if val, ok := arg.(parser.Value); ok && val.Type == parser.ValueTypeVar && param.Kind == ParamVar {
+			names = append(names, val.Value)
+		}
+	}
+
+	return names
+}
+
+// localNames returns the parameters of a function followed by every other
+// variable it assigns, directly or through the output argument of a builtin,
+// which together make up its local variables.
+func (c *compiler) localNames(fn parser.Func) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range fn.Params {
+		add(name)
+	}
+
+	for _, stmt := range fn.Body {
+		switch stmt := stmt.(type) {
+		case parser.VarDecl:
+			add(stmt.Name)
+		case parser.Call:
+			for _, name := range c.outputs(stmt) {
+				add(name)
+			}
+		}
+	}
+
+	return names
+}
+
+// temporaries returns the scope of the top level, made up of the variables
+// that lowering its blocks introduced.
+func temporaries(stmts []parser.Stmt) *Function {
+	fn := &Function{slots: map[string]int{}}
+
+	for _, stmt := range stmts {
+		decl, ok := stmt.(parser.VarDecl)
+		if !ok || !decl.Local {
+			continue
+		}
+
+		if _, ok := fn.slots[decl.Name]; !ok {
+			fn.slots[decl.Name] = len(fn.Locals)
+			fn.Locals = append(fn.Locals, decl.Name)
+		}
+	}
+
+	return fn
+}
+
+// Compile turns a parsed program into bytecode, with calls to builtins
+// compiled against the signatures in builtins, usually VM.Funcs. The code can
+// run on any VM with the same builtins. Variables assigned inside a function
+// body, including those passed to a builtin to write to, are local to it; all
+// other variables are global.
+func Compile(program *parser.Program, builtins map[string]ExternalFunc) *Code {
+	c := &compiler{
+		code:     &Code{Labels: map[int]string{}},
+		globals:  map[string]int{},
+		funcs:    map[string]int{},
+		builtins: builtins,
+	}
+
+	decls := []parser.Func{}
+
+	for _, stmt := range program.Stmts {
+		if stmt.Type() != parser.StmtTypeFunc {
+			continue
+		}
+
+		decl := stmt.(parser.Func)
+		c.funcs[decl.Name] = len(decls)
+		decls = append(decls, decl)
+	}
+
+	for _, decl := range decls {
+		locals := c.localNames(decl)
+
+		fn := &Function{
+			Name:   decl.Name,
+			Params: len(decl.Params),
+			Locals: locals,
+			slots:  make(map[string]int, len(locals)),
+		}
+
+		for i, name := range locals {
+			fn.slots[name] = i
+
+			if counted(name) {
+				fn.counted++
+			}
+		}
+
+		c.code.Funcs = append(c.code.Funcs, fn)
+	}
+
+	c.code.Main = temporaries(program.Stmts)
+	c.fn = c.code.Main
+	c.compileScope(program.Stmts)
+	c.emit(OpHalt, 0, lexer.TokenContext{})
+
+	for i, decl := range decls {
+		c.fn = c.code.Funcs[i]
+		c.fn.Entry = len(c.code.Instrs)
+		c.compileScope(decl.Body)
+	}
+
+	return c.code
+}
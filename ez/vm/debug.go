@@ -0,0 +1,468 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+)
+
+// ErrDebugQuit is returned by Debugger.Run when the program is stopped from
+// the debugger before it finishes.
+var ErrDebugQuit = errors.New("debugging stopped")
+
+// Number of most recent jumps kept by a Debugger.
+const jumpHistory = 100
+
+// Action tells a Debugger how to carry on after it stops.
+type Action int
+
+const (
+	ActionStep     Action = iota // stop at the next line, entering calls
+	ActionNext                   // stop at the next line in the same or an outer frame
+	ActionOut                    // stop once the current frame has returned
+	ActionContinue               // run until a breakpoint or watchpoint
+	ActionQuit                   // stop the program
+)
+
+type StopReason string
+
+const (
+	StopEntry      StopReason = "entry"
+	StopStep       StopReason = "step"
+	StopBreakpoint StopReason = "breakpoint"
+	StopWatchpoint StopReason = "watchpoint"
+	StopPause      StopReason = "pause"
+)
+
+// Stop describes where and why a Debugger stopped. ID is the breakpoint or
+// watchpoint that was hit, if any.
+type Stop struct {
+	Reason  StopReason
+	ID      int
+	Message string
+	Context lexer.TokenContext
+	Depth   int
+}
+
+// Breakpoint stops before the first statement of a line, or only when its
+// condition is non-zero if it has one.
+type Breakpoint struct {
+	ID        int
+	Line      int
+	Condition string
+	Hits      int
+
+	cond parser.Expr
+}
+
+// Watchpoint stops after a statement changes a variable, or a memory address
+// when Var is empty. A watchpoint on a local variable belongs to the frame it
+// was set in and is removed when that frame returns.
+type Watchpoint struct {
+	ID   int
+	Var  string
+	Addr int
+
+	frame   int
+	serial  uint64
+	fn      *Function
+	value   int64
+	defined bool
+}
+
+func (w *Watchpoint) String() string {
+	if w.Var == "" {
+		return fmt.Sprintf("memory[%d]", w.Addr)
+	}
+
+	return w.Var
+}
+
+// Jump is a transfer of control between two statements that are not next to
+// each other, including calls and returns. Label is the label jumped to, if any.
+type Jump struct {
+	From  lexer.TokenContext
+	To    lexer.TokenContext
+	Label string
+}
+
+// Debugger runs compiled code on a VM and calls OnStop whenever it stops. The
+// VM can be inspected from OnStop, which returns how to carry on. Breakpoints
+// and watchpoints may be changed and Pause called from other goroutines while
+// the program runs.
+type Debugger struct {
+	VM          *VM
+	Code        *Code
+	StopOnEntry bool
+	OnStop      func(Stop) Action
+
+	mu          sync.Mutex
+	paused      atomic.Bool
+	breakpoints []*Breakpoint
+	watchpoints []*Watchpoint
+	jumps       []Jump
+	lastID      int
+
+	following map[int]int
+	lines     []int
+
+	action     Action
+	depth      int
+	prev       int
+	line       int
+	lineDepth  int
+	started    bool
+	evaluating bool
+}
+
+func NewDebugger(vm *VM, code *Code) *Debugger {
+	d := &Debugger{
+		VM:        vm,
+		Code:      code,
+		following: map[int]int{},
+	}
+
+	// Record the statement that follows each one, to tell jumps apart from
+	// running on to the next statement.
+	prev := -1
+	seen := map[int]bool{}
+
+	for pc, start := range code.Stmts {
+		if !start {
+			continue
+		}
+
+		if prev != -1 {
+			d.following[prev] = pc
+		}
+		prev = pc
+
+		if line := code.Contexts[pc].Line; line > 0 && !seen[line] {
+			seen[line] = true
+			d.lines = append(d.lines, line)
+		}
+	}
+
+	sort.Ints(d.lines)
+
+	vm.code = code
+
+	return d
+}
+
+// AddBreakpoint adds a breakpoint on the first line at or after the given one
+// that has a statement. The condition is an expression which may compare two
+// values, such as "x > 10", or empty.
+func (d *Debugger) AddBreakpoint(line int, condition string) (*Breakpoint, error) {
+	i := sort.SearchInts(d.lines, line)
+	if i == len(d.lines) {
+		return nil, fmt.Errorf("no statement on or after line %d", line)
+	}
+
+	bp := &Breakpoint{Line: d.lines[i], Condition: condition}
+
+	if condition != "" {
+		cond, err := parseExpr(condition)
+		if err != nil {
+			return nil, err
+		}
+
+		bp.cond = cond
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastID++
+	bp.ID = d.lastID
+	d.breakpoints = append(d.breakpoints, bp)
+
+	return bp, nil
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]*Breakpoint{}, d.breakpoints...)
+}
+
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.breakpoints = nil
+}
+
+// Pause stops the program before the next statement it runs.
+func (d *Debugger) Pause() {
+	d.paused.Store(true)
+}
+
+// WatchVar watches a variable in the scope the program is stopped in, which
+// does not need to exist yet.
+func (d *Debugger) WatchVar(name string) *Watchpoint {
+	w := &Watchpoint{Var: name, frame: -1}
+
+	if fn := d.VM.fn; fn != nil && fn != d.VM.top.fn {
+		if _, ok := fn.slots[name]; ok {
+			w.frame = len(d.VM.frames) - 1
+			w.fn = fn
+			w.serial = d.VM.frames[w.frame].serial
+		}
+	}
+
+	return d.watch(w)
+}
+
+func (d *Debugger) WatchMemory(addr int) (*Watchpoint, error) {
+	if addr < 0 || addr >= len(d.VM.Memory) {
+		return nil, fmt.Errorf("invalid memory address: %d", addr)
+	}
+
+	return d.watch(&Watchpoint{Addr: addr, frame: -1}), nil
+}
+
+func (d *Debugger) watch(w *Watchpoint) *Watchpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w.value, w.defined, _ = d.read(w)
+
+	d.lastID++
+	w.ID = d.lastID
+	d.watchpoints = append(d.watchpoints, w)
+
+	return w
+}
+
+func (d *Debugger) Watchpoints() []*Watchpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]*Watchpoint{}, d.watchpoints...)
+}
+
+// Remove deletes the breakpoint or watchpoint with the given ID.
+func (d *Debugger) Remove(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+
+	for i, w := range d.watchpoints {
+		if w.ID == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Jumps returns a copy of the most recent jumps, oldest first.
+func (d *Debugger) Jumps() []Jump {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return slices.Clone(d.jumps)
+}
+
+// Eval evaluates an expression in the scope the program is stopped in.
+func (d *Debugger) Eval(expr string) (int64, error) {
+	parsed, err := parseExpr(expr)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.eval(parsed)
+}
+
+func (d *Debugger) eval(expr parser.Expr) (int64, error) {
+	d.evaluating = true
+	defer func() { d.evaluating = false }()
+
+	return d.VM.eval(expr)
+}
+
+func parseExpr(expr string) (parser.Expr, error) {
+	tokens, err := lexer.Lex(expr, "<expr>")
+	if err != nil {
+		return nil, err
+	}
+
+	return parser.ParseExpr(tokens)
+}
+
+// read returns the watched value, and false as the last result once the frame
+// of a local variable has returned.
+func (d *Debugger) read(w *Watchpoint) (int64, bool, bool) {
+	if w.Var == "" {
+		return d.VM.Memory[w.Addr], true, true
+	}
+
+	if w.frame == -1 {
+		val, defined := d.VM.Variables.Get(w.Var)
+		return val, defined, true
+	}
+
+	// A later call at the same depth gets a new frame with its own locals.
+	if w.frame >= len(d.VM.frames) || d.VM.frames[w.frame].serial != w.serial {
+		return 0, false, false
+	}
+
+	frame := d.VM.frames[w.frame]
+	slot := w.fn.slots[w.Var]
+
+	return frame.locals[slot], frame.defined[slot], true
+}
+
+// Run runs the code to completion, stopping as the breakpoints, watchpoints
+// and the actions returned by OnStop require.
+func (d *Debugger) Run() error {
+	d.action = ActionContinue
+	if d.StopOnEntry {
+		d.action = ActionStep
+	}
+
+	d.prev = -1
+	d.line = 0
+	d.started = false
+
+	d.VM.Hook = d.hook
+	defer func() { d.VM.Hook = nil }()
+
+	return d.VM.Exec(d.Code)
+}
+
+func (d *Debugger) hook(pc int) error {
+	if d.evaluating {
+		return nil
+	}
+
+	ctx := d.Code.Contexts[pc]
+	depth := len(d.VM.frames)
+
+	if next, ok := d.following[d.prev]; d.prev != -1 && (!ok || next != pc) {
+		d.mu.Lock()
+		d.jumps = append(d.jumps, Jump{From: d.Code.Contexts[d.prev], To: ctx, Label: d.Code.Labels[pc]})
+
+		if len(d.jumps) > jumpHistory {
+			d.jumps = d.jumps[1:]
+		}
+		d.mu.Unlock()
+	}
+
+	newLine := ctx.Line > 0 && (ctx.Line != d.line || depth != d.lineDepth)
+	d.prev, d.line, d.lineDepth = pc, ctx.Line, depth
+
+	d.mu.Lock()
+	stop := d.check(ctx, depth, newLine)
+	d.mu.Unlock()
+
+	if stop == nil && ctx.Line > 0 && d.paused.Swap(false) {
+		stop = &Stop{Reason: StopPause}
+	}
+
+	if stop == nil {
+		return nil
+	}
+
+	d.started = true
+
+	stop.Context = ctx
+	stop.Depth = depth
+
+	action := ActionContinue
+	if d.OnStop != nil {
+		action = d.OnStop(*stop)
+	}
+
+	if action == ActionQuit {
+		return ErrDebugQuit
+	}
+
+	d.action = action
+	d.depth = depth
+
+	return nil
+}
+
+// check returns why the debugger should stop before a statement, if it should.
+func (d *Debugger) check(ctx lexer.TokenContext, depth int, newLine bool) *Stop {
+	var stop *Stop
+
+	if newLine {
+		switch {
+		case d.action == ActionStep,
+			d.action == ActionNext && depth <= d.depth,
+			d.action == ActionOut && depth < d.depth:
+			stop = &Stop{Reason: StopStep}
+
+			if !d.started {
+				stop.Reason = StopEntry
+			}
+		}
+
+		for _, bp := range d.breakpoints {
+			if bp.Line != ctx.Line {
+				continue
+			}
+
+			message := fmt.Sprintf("breakpoint %d", bp.ID)
+
+			if bp.cond != nil {
+				val, err := d.eval(bp.cond)
+				if err != nil {
+					message = fmt.Sprintf("breakpoint %d condition failed: %s", bp.ID, err)
+				} else if val == 0 {
+					continue
+				}
+			}
+
+			bp.Hits++
+			stop = &Stop{Reason: StopBreakpoint, ID: bp.ID, Message: message}
+
+			break
+		}
+	}
+
+	kept := d.watchpoints[:0]
+
+	for _, w := range d.watchpoints {
+		val, defined, ok := d.read(w)
+		if !ok {
+			stop = &Stop{Reason: StopWatchpoint, ID: w.ID, Message: fmt.Sprintf("%s went out of scope, watchpoint %d removed", w, w.ID)}
+			continue
+		}
+
+		kept = append(kept, w)
+
+		if val == w.value && defined == w.defined {
+			continue
+		}
+
+		message := fmt.Sprintf("%s = %d (was %d)", w, val, w.value)
+		if !w.defined {
+			message = fmt.Sprintf("%s = %d (was unset)", w, val)
+		}
+
+		w.value, w.defined = val, defined
+		stop = &Stop{Reason: StopWatchpoint, ID: w.ID, Message: message}
+	}
+
+	d.watchpoints = kept
+
+	return stop
+}
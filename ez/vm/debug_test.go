@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/parser"
+)
+
+func compileSource(t *testing.T, vm *VM, code string) *Code {
+	t.Helper()
+
+	tokens, err := lexer.Lex(code, "test.ez")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	program, err := parser.Parse(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Compile(program, vm.Funcs)
+}
+
+func TestWatchLocalAcrossCalls(t *testing.T) {
+	vm := New(16)
+	vm.Stdout = io.Discard
+
+	code := compileSource(t, vm, strings.Join([]string{
+		"func f(a)",
+		"    x = a",
+		"    x = x + 1",
+		"    return x",
+		"end",
+		"func g()",
+		"    return 5",
+		"end",
+		"r = f(1) + g()",
+	}, "\n"))
+
+	d := NewDebugger(vm, code)
+	if _, err := d.AddBreakpoint(3, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stops := []string{}
+	d.OnStop = func(stop Stop) Action {
+		stops = append(stops, stop.Message)
+
+		if stop.Reason == StopBreakpoint {
+			d.WatchVar("x")
+		}
+
+		return ActionContinue
+	}
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, _ := vm.Variables.Get("r"); r != 7 {
+		t.Fatalf("r = %d, want 7", r)
+	}
+
+	if len(d.Watchpoints()) != 0 {
+		t.Fatalf("watchpoint on a returned frame was kept: %v", stops)
+	}
+}
+
+// An expression that fails inside a function it calls leaves the stopped
+// program as it was.
+func TestEvalErrorKeepsFrames(t *testing.T) {
+	vm := New(16)
+	vm.Stdout = io.Discard
+
+	code := compileSource(t, vm, strings.Join([]string{
+		"func div(a, b)",
+		"    return a / b",
+		"end",
+		"func f(a)",
+		"    x = a * 2",
+		"    return x",
+		"end",
+		"r = f(3)",
+	}, "\n"))
+
+	d := NewDebugger(vm, code)
+	if _, err := d.AddBreakpoint(6, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var evalErr error
+	var frames int
+	var x int64
+
+	d.OnStop = func(stop Stop) Action {
+		if stop.Reason == StopBreakpoint {
+			_, evalErr = d.Eval("div(x, 0)")
+			frames = len(vm.Frames())
+			x, _ = d.Eval("x")
+		}
+
+		return ActionContinue
+	}
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(evalErr, ErrDivisionByZero) {
+		t.Fatalf("eval error %v, want %v", evalErr, ErrDivisionByZero)
+	}
+
+	if frames != 1 || x != 6 {
+		t.Fatalf("after the failed call: %d frames and x = %d, want 1 and 6", frames, x)
+	}
+
+	if r, _ := vm.Variables.Get("r"); r != 6 {
+		t.Fatalf("r = %d, want 6", r)
+	}
+}
+
+func TestJumpsIsACopy(t *testing.T) {
+	vm := New(16)
+	vm.Stdout = io.Discard
+
+	d := NewDebugger(vm, compileSource(t, vm, "i = 0\n:loop\ni = i + 1\nif i < 3 goto loop"))
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	jumps := d.Jumps()
+	if len(jumps) == 0 {
+		t.Fatal("no jumps recorded")
+	}
+
+	jumps[0] = Jump{}
+	if d.Jumps()[0] == (Jump{}) {
+		t.Fatal("changing the returned jumps changed the debugger's")
+	}
+}
@@ -0,0 +1,16 @@
+package vm
+
+import "errors"
+
+// Errors that stop a run. They are returned as lexer.Diagnostics positioned
+// where execution stopped, and can be told apart with errors.Is.
+var (
+	ErrCancelled      = errors.New("execution cancelled")
+	ErrTimeout        = errors.New("execution timed out")
+	ErrStepLimit      = errors.New("step limit exceeded")
+	ErrDepthLimit     = errors.New("maximum call depth exceeded")
+	ErrMemoryQuota    = errors.New("memory quota exceeded")
+	ErrVariableQuota  = errors.New("variable quota exceeded")
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrOverflow       = errors.New("integer overflow")
+)
@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+const DefaultMaxDepth = 1000
+
+// Number of innermost frames shown in a runtime error's call stack.
+const traceLimit = 10
+
+// Frame is one entry on the call stack, pushed by a function call or a gosub.
+// Function frames get their own locals; gosub frames share the caller's scope.
+type Frame struct {
+	Name   string
+	Caller lexer.TokenContext
+
+	fn       *Function
+	locals   []int64
+	defined  []bool
+	returnTo int
+	gosub    bool
+
+	// serial tells apart frames that are at the same depth at different times.
+	serial uint64
+}
+
+// Locals returns a copy of the defined local variables of the frame.
+func (f Frame) Locals() map[string]int64 {
+	locals := map[string]int64{}
+
+	if f.fn == nil {
+		return locals
+	}
+
+	for slot, name := range f.fn.Locals {
+		if f.defined[slot] {
+			locals[name] = f.locals[slot]
+		}
+	}
+
+	return locals
+}
+
+// enterScope points the VM's current scope at the innermost frame, or at the
+// top level when there is none.
+func (vm *VM) enterScope() {
+	if len(vm.frames) == 0 {
+		vm.fn, vm.locals, vm.defined = vm.top.fn, vm.top.locals, vm.top.defined
+		return
+	}
+
+	frame := &vm.frames[len(vm.frames)-1]
+	vm.fn, vm.locals, vm.defined = frame.fn, frame.locals, frame.defined
+}
+
+// getVar looks a variable up by name in the current scope, falling back to globals.
+func (vm *VM) getVar(name string) (int64, bool) {
+	if vm.fn != nil {
+		if slot, ok := vm.fn.slots[name]; ok {
+			return vm.locals[slot], vm.defined[slot]
+		}
+	}
+
+	return vm.Variables.Get(name)
+}
+
+func (vm *VM) setVar(name string, val int64) {
+	if vm.fn != nil {
+		if slot, ok := vm.fn.slots[name]; ok {
+			vm.locals[slot] = val
+			vm.defined[slot] = true
+			return
+		}
+	}
+
+	vm.Variables.Set(name, val)
+}
+
+func (vm *VM) pushFrame(frame Frame, ctx lexer.TokenContext) error {
+	if len(vm.frames) >= vm.MaxDepth {
+		return ctx.Wrap("runtime", fmt.Errorf("%w (%d)", ErrDepthLimit, vm.MaxDepth))
+	}
+
+	vm.serial++
+	frame.serial = vm.serial
+
+	vm.frames = append(vm.frames, frame)
+	vm.enterScope()
+
+	return nil
+}
+
+// callFunc moves the arguments of a call off the stack into a new frame and
+// jumps to the start of the function.
+func (vm *VM) callFunc(index int, ctx lexer.TokenContext) error {
+	fn := vm.code.Funcs[index]
+
+	locals := make([]int64, len(fn.Locals))
+	defined := make([]bool, len(fn.Locals))
+
+	base := len(vm.stack) - fn.Params
+	copy(locals, vm.stack[base:])
+	vm.stack = vm.stack[:base]
+
+	for i := 0; i < fn.Params; i++ {
+		defined[i] = true
+	}
+
+	err := vm.pushFrame(Frame{
+		Name:     fn.Name,
+		Caller:   ctx,
+		fn:       fn,
+		locals:   locals,
+		defined:  defined,
+		returnTo: vm.pc,
+	}, ctx)
+	if err != nil {
+		return err
+	}
+
+	vm.nlocal += fn.counted
+	if err := vm.quota(ctx); err != nil {
+		return err
+	}
+
+	vm.pc = fn.Entry
+
+	return nil
+}
+
+func (vm *VM) gosub(target int, ctx lexer.TokenContext) error {
+	err := vm.pushFrame(Frame{
+		Name:     vm.code.Labels[target],
+		Caller:   ctx,
+		fn:       vm.fn,
+		locals:   vm.locals,
+		defined:  vm.defined,
+		returnTo: vm.pc,
+		gosub:    true,
+	}, ctx)
+	if err != nil {
+		return err
+	}
+
+	vm.pc = target
+
+	return nil
+}
+
+func (vm *VM) returnFrom(ctx lexer.TokenContext) error {
+	if len(vm.frames) == 0 {
+		return ctx.Error("runtime", "return outside of function or gosub")
+	}
+
+	val := vm.pop()
+
+	frame := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.enterScope()
+
+	vm.pc = frame.returnTo
+
+	if !frame.gosub {
+		vm.nlocal -= frame.fn.counted
+		vm.push(val)
+	}
+
+	return nil
+}
+
+// withTrace adds the active call stack to a runtime error and unwinds it.
+func (vm *VM) withTrace(err error) error {
+	defer func() {
+		vm.frames = nil
+		vm.nlocal = 0
+		vm.enterScope()
+	}()
+
+	var diag lexer.Diagnostic
+	if len(vm.frames) == 0 || !errors.As(err, &diag) {
+		return err
+	}
+
+	diag.Notes = append(diag.Notes, "", "Call stack (most recent call first):")
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		if len(vm.frames)-i > traceLimit {
+			diag.Notes = append(diag.Notes, fmt.Sprintf("  ... %d more", i+1))
+			break
+		}
+
+		frame := vm.frames[i]
+		diag.Notes = append(diag.Notes, fmt.Sprintf("  %s called from %s, line %d col %d", frame.Name, frame.Caller.File(), frame.Caller.Line, frame.Caller.Column))
+	}
+
+	return diag
+}
+
+// Frames returns a copy of the call stack, innermost frame last.
+func (vm *VM) Frames() []Frame {
+	return append([]Frame{}, vm.frames...)
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// FileSystem is where the read_file and write_file builtins find files.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+}
+
+// OSFileSystem reads and writes files with the os package, relative to the
+// working directory of the process.
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (OSFileSystem) WriteFile(name string, data []byte) error {
+	return os.WriteFile(name, data, 0644)
+}
+
+// Dir confines files to the directory root. Names are slash separated and
+// relative to root; ones that would leave it, such as "../x", "/etc/passwd"
+// or a symlink pointing outside, are rejected.
+type Dir string
+
+// open opens the root and checks name, which it returns in the form os.Root
+// expects.
+func (d Dir) open(op, name string) (*os.Root, string, error) {
+	name = path.Clean(name)
+	if !fs.ValidPath(name) {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+
+	root, err := os.OpenRoot(string(d))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return root, filepath.FromSlash(name), nil
+}
+
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	root, name, err := d.open("read", name)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	file, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func (d Dir) WriteFile(name string, data []byte) error {
+	root, name, err := d.open("write", name)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	file, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// FromFS reads files from fsys, such as an embed.FS. Writing always fails.
+func FromFS(fsys fs.FS) FileSystem {
+	return readOnlyFS{fsys}
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+func (r readOnlyFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, path.Clean(name))
+}
+
+func (r readOnlyFS) WriteFile(name string, data []byte) error {
+	return &fs.PathError{Op: "write", Path: name, Err: fs.ErrPermission}
+}
@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirConfinesPaths(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "file-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("a.txt", filepath.Join(root, "inside-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := Dir(root)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"./a.txt", true},
+		{"sub/../a.txt", true},
+		{"inside-link", true},
+		{"../a.txt", false},
+		{"sub/../../a.txt", false},
+		{"/etc/hostname", false},
+		{filepath.Join(outside, "secret"), false},
+		{"link/secret", false},
+		{"link/secret2", false},
+		{"file-link", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := dir.ReadFile(test.name)
+			if test.ok {
+				if err != nil || string(data) != "a" {
+					t.Fatalf("ReadFile(%q) = %q, %v; want %q", test.name, data, err, "a")
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("ReadFile(%q) = %q; want an error", test.name, data)
+			}
+
+			if err := dir.WriteFile(test.name, []byte("x")); err == nil {
+				t.Fatalf("WriteFile(%q) succeeded; want an error", test.name)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(filepath.Join(outside, "secret"))
+	if err != nil || string(data) != "secret" {
+		t.Fatalf("file outside the root was changed: %q, %v", data, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "secret2")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("file created outside the root: %v", err)
+	}
+}
+
+func TestDirWriteFile(t *testing.T) {
+	root := t.TempDir()
+	dir := Dir(root)
+
+	if err := dir.WriteFile("out.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := dir.ReadFile("out.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadFile = %q, %v; want %q", data, err, "hello")
+	}
+}
+
+func TestFromFSIsReadOnly(t *testing.T) {
+	fsys := FromFS(os.DirFS(t.TempDir()))
+
+	if err := fsys.WriteFile("x", nil); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("WriteFile = %v; want fs.ErrPermission", err)
+	}
+}
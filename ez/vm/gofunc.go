@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterGo registers a Go function as a builtin, deriving its signature from
+// the function's type:
+//
+//   - integer and bool parameters take any expression
+//   - string parameters take a string literal
+//   - pointers to integers or bools take a variable, which the function can
+//     read and write
+//   - a final variadic parameter of any of those takes the rest of the
+//     arguments
+//   - each result other than a final error takes a variable it is written to,
+//     after the parameters
+//
+// A first context.Context parameter is passed the context of the run rather
+// than an argument. A non-nil error is returned as a runtime error at the
+// call, and results are not written. For example, func(a, b int64) (int64,
+// error) is called as `call add 1 2 sum`.
+func (vm *VM) RegisterGo(name string, fn any) error {
+	value := reflect.ValueOf(fn)
+	if value.Kind() != reflect.Func || value.IsNil() {
+		return fmt.Errorf("%s: %T is not a function", name, fn)
+	}
+
+	typ := value.Type()
+
+	first := 0
+	if typ.NumIn() > 0 && typ.In(0) == contextType {
+		first = 1
+	}
+
+	results := typ.NumOut()
+	fails := results > 0 && typ.Out(results-1) == errorType
+	if fails {
+		results--
+	}
+
+	if typ.IsVariadic() && results > 0 {
+		return fmt.Errorf("%s: a variadic function cannot return values", name)
+	}
+
+	sig := Signature{}
+	params := []reflect.Type{}
+
+	for i := first; i < typ.NumIn(); i++ {
+		param := typ.In(i)
+		variadic := typ.IsVariadic() && i == typ.NumIn()-1
+		if variadic {
+			param = param.Elem()
+		}
+
+		var p Param
+		switch {
+		case isInt(param):
+			p = In(fmt.Sprintf("arg%d", len(sig)+1))
+		case param.Kind() == reflect.String:
+			p = Str(fmt.Sprintf("arg%d", len(sig)+1))
+		case param.Kind() == reflect.Pointer && isInt(param.Elem()):
+			p = Out(fmt.Sprintf("var%d", len(sig)+1))
+		default:
+			return fmt.Errorf("%s: unsupported parameter type %s", name, typ.In(i))
+		}
+
+		if variadic {
+			p = p.Opt().Many()
+		}
+
+		sig = append(sig, p)
+		params = append(params, param)
+	}
+
+	for i := 0; i < results; i++ {
+		if !isInt(typ.Out(i)) {
+			return fmt.Errorf("%s: unsupported result type %s", name, typ.Out(i))
+		}
+
+		sig = append(sig, Out(fmt.Sprintf("result%d", i+1)))
+	}
+
+	vm.RegisterFunc(name, sig, func(ctx lexer.TokenContext, args []Arg) error {
+		inputs := args[:len(args)-results]
+
+		in := []reflect.Value{}
+		if first == 1 {
+			in = append(in, reflect.ValueOf(vm.ctx))
+		}
+
+		type output struct {
+			arg Arg
+			val reflect.Value
+		}
+
+		outputs := []output{}
+
+		for i, arg := range inputs {
+			param := params[min(i, len(params)-1)]
+
+			switch {
+			case param.Kind() == reflect.String:
+				in = append(in, reflect.ValueOf(arg.String).Convert(param))
+			case param.Kind() == reflect.Pointer:
+				ptr := reflect.New(param.Elem())
+				if val, ok := arg.Var.Get(); ok {
+					if err := setInt(ptr.Elem(), val); err != nil {
+						return arg.Context().Wrap("runtime", err)
+					}
+				}
+
+				in = append(in, ptr)
+				outputs = append(outputs, output{arg, ptr.Elem()})
+			default:
+				val := reflect.New(param).Elem()
+				if err := setInt(val, arg.Int); err != nil {
+					return arg.Context().Wrap("runtime", err)
+				}
+
+				in = append(in, val)
+			}
+		}
+
+		out := value.Call(in)
+
+		if fails {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return ctx.Wrap("runtime", err)
+			}
+		}
+
+		for i := 0; i < results; i++ {
+			outputs = append(outputs, output{args[len(inputs)+i], out[i]})
+		}
+
+		for _, output := range outputs {
+			val, err := getInt(output.val)
+			if err != nil {
+				return output.arg.Context().Wrap("runtime", err)
+			}
+
+			output.arg.Var.Set(val)
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+func isInt(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+
+	return false
+}
+
+// setInt stores n in val, which must be of a type isInt accepts.
+func setInt(val reflect.Value, n int64) error {
+	switch {
+	case val.Kind() == reflect.Bool:
+		val.SetBool(n != 0)
+	case val.CanInt():
+		if val.OverflowInt(n) {
+			return fmt.Errorf("%w: %d does not fit in %s", ErrOverflow, n, val.Type())
+		}
+
+		val.SetInt(n)
+	default:
+		if n < 0 || val.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%w: %d does not fit in %s", ErrOverflow, n, val.Type())
+		}
+
+		val.SetUint(uint64(n))
+	}
+
+	return nil
+}
+
+// getInt returns the value of val, which must be of a type isInt accepts.
+func getInt(val reflect.Value) (int64, error) {
+	switch {
+	case val.Kind() == reflect.Bool:
+		return truth(val.Bool()), nil
+	case val.CanInt():
+		return val.Int(), nil
+	}
+
+	if val.Uint() > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: %d does not fit in an ez integer", ErrOverflow, val.Uint())
+	}
+
+	return int64(val.Uint()), nil
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRegisterGo(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   any
+		code string
+		vars map[string]int64
+		err  string
+	}{
+		{"results", func(a, b int64) (int64, error) { return a + b, nil }, "call f 1 2 r", map[string]int64{"r": 3}, ""},
+		{"several results", func(a int64) (int64, int64) { return a / 2, a % 2 }, "call f 7 q r", map[string]int64{"q": 3, "r": 1}, ""},
+		{"string", func(s string, out *int64) error { *out = int64(len(s)); return nil }, "call f \"hello\" n", map[string]int64{"n": 5}, ""},
+		{"pointer", func(p *int64) { *p *= 2 }, "x = 4\ncall f x", map[string]int64{"x": 8}, ""},
+		{"variadic", func(out *int64, xs ...int64) {
+			for _, x := range xs {
+				*out += x
+			}
+		}, "call f s 1 2 3", map[string]int64{"s": 6}, ""},
+		{"bool", func(b bool) bool { return !b }, "call f 0 r", map[string]int64{"r": 1}, ""},
+		{"small integers", func(a int8, b uint16) int32 { return int32(a) * int32(b) }, "call f -2 300 r", map[string]int64{"r": -600}, ""},
+		{"context", func(ctx context.Context) bool { return ctx != nil }, "call f r", map[string]int64{"r": 1}, ""},
+		{"error", func() error { return errors.New("boom") }, "call f", nil, "boom"},
+		{"error discards outputs", func(p *int64) error { *p = 9; return errors.New("boom") }, "x = 1\ncall f x", map[string]int64{"x": 1}, "boom"},
+		{"argument overflow", func(a int8) {}, "call f 300", nil, "integer overflow"},
+		{"negative unsigned", func(a uint) {}, "call f -1", nil, "integer overflow"},
+		{"result overflow", func() uint64 { return math.MaxUint64 }, "call f r", nil, "integer overflow"},
+		{"string where integer expected", func(a int64) {}, "call f \"x\"", nil, "unexpected string literal"},
+		{"expression where variable expected", func(p *int64) {}, "call f 1 + 2", nil, "expected identifier"},
+		{"too many arguments", func(a int64) {}, "call f 1 2", nil, "incorrect number of arguments"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+			vm.Stdout = io.Discard
+
+			if err := vm.RegisterGo("f", test.fn); err != nil {
+				t.Fatal(err)
+			}
+
+			err := vm.Exec(compileSource(t, vm, test.code))
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got %v, want %q", err, test.err)
+			}
+
+			for name, want := range test.vars {
+				if got, ok := vm.Variables.Get(name); !ok || got != want {
+					t.Errorf("%s = %d (defined %t), want %d", name, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterGoRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   any
+	}{
+		{"not a function", 5},
+		{"nil function", (func())(nil)},
+		{"float parameter", func(f float64) {}},
+		{"slice parameter", func(xs []int64) {}},
+		{"string result", func() string { return "" }},
+		{"variadic with results", func(xs ...int64) int64 { return 0 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+
+			if err := vm.RegisterGo("f", test.fn); err == nil {
+				t.Fatal("registered; want an error")
+			}
+
+			if _, ok := vm.Funcs["f"]; ok {
+				t.Fatal("builtin was registered despite the error")
+			}
+		})
+	}
+}
+
+func TestRegisterGoSignature(t *testing.T) {
+	vm := New(16)
+
+	if err := vm.RegisterGo("f", func(ctx context.Context, a int64, s string, p *int64, rest ...int64) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<arg1> "arg2" <var3> [<arg4>...]`
+	if got := vm.Funcs["f"].Signature.String(); got != want {
+		t.Fatalf("signature %s, want %s", got, want)
+	}
+}
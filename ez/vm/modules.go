@@ -0,0 +1,219 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+// Permission is the name of a capability a host can grant to programs. Each
+// one enables a module of builtins, which are not registered otherwise.
+type Permission string
+
+const (
+	PermFSRead  Permission = "fs-read"  // read_file
+	PermFSWrite Permission = "fs-write" // write_file
+	PermTTY     Permission = "tty"      // vm_no_input_buffering
+	PermEnv     Permission = "env"      // getenv
+	PermClock   Permission = "clock"    // time_ms, sleep_ms
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Permission of each builtin that needs one.
+var builtinPermissions = map[string]Permission{
+	"read_file":             PermFSRead,
+	"write_file":            PermFSWrite,
+	"vm_no_input_buffering": PermTTY,
+	"getenv":                PermEnv,
+	"time_ms":               PermClock,
+	"sleep_ms":              PermClock,
+}
+
+// PermissionFor returns the permission a builtin needs, if any.
+func PermissionFor(name string) (Permission, bool) {
+	perm, ok := builtinPermissions[name]
+	return perm, ok
+}
+
+// denied returns the error for a call to a builtin whose permission was not
+// granted, or nil if name is not such a builtin.
+func denied(name string, ctx lexer.TokenContext) error {
+	perm, ok := builtinPermissions[name]
+	if !ok {
+		return nil
+	}
+
+	return ctx.Wrap("runtime", fmt.Errorf("%w: %s needs the %s permission", ErrPermissionDenied, name, perm))
+}
+
+// Permissions are the capabilities granted to a VM. The file systems decide
+// which files read_file and write_file can reach; nil denies access.
+type Permissions struct {
+	FSRead  FileSystem
+	FSWrite FileSystem
+	TTY     bool
+	Env     bool
+	Clock   bool
+}
+
+// Unrestricted grants every permission, with files resolved like the os
+// package does. It is meant for running your own programs, as ez does.
+func Unrestricted() Permissions {
+	return Permissions{
+		FSRead:  OSFileSystem{},
+		FSWrite: OSFileSystem{},
+		TTY:     true,
+		Env:     true,
+		Clock:   true,
+	}
+}
+
+// Grant registers the builtins of each granted permission.
+func (vm *VM) Grant(perms Permissions) {
+	if perms.FSRead != nil {
+		vm.registerFSRead(perms.FSRead)
+	}
+
+	if perms.FSWrite != nil {
+		vm.registerFSWrite(perms.FSWrite)
+	}
+
+	if perms.TTY {
+		vm.registerTTY()
+	}
+
+	if perms.Env {
+		vm.registerEnv()
+	}
+
+	if perms.Clock {
+		vm.registerClock()
+	}
+}
+
+func (vm *VM) registerFSRead(fsys FileSystem) {
+	// call read_file <filename> <addr> <length_var>
+	vm.RegisterFunc("read_file", Signature{Str("filename"), In("addr"), Out("length_var")}, func(ctx lexer.TokenContext, args []Arg) error {
+		address := args[1].Int
+		if address < 0 || address >= int64(len(vm.Memory)) {
+			return args[1].Context().Error("runtime", "invalid memory address")
+		}
+
+		data, err := fsys.ReadFile(args[0].String)
+		if err != nil {
+			return args[0].Context().Wrap("runtime", err)
+		}
+
+		if address+int64(len(data)) >= int64(len(vm.Memory)) {
+			return ctx.Error("runtime", "file too large")
+		}
+
+		for i, b := range data {
+			vm.Memory[address+int64(i)] = int64(b)
+		}
+
+		args[2].Var.Set(int64(len(data)))
+
+		return nil
+	})
+}
+
+func (vm *VM) registerFSWrite(fsys FileSystem) {
+	// call write_file <filename> <addr> <length>
+	vm.RegisterFunc("write_file", Signature{Str("filename"), In("addr"), In("length")}, func(ctx lexer.TokenContext, args []Arg) error {
+		address, flen := args[1].Int, args[2].Int
+		if address < 0 || address >= int64(len(vm.Memory)) {
+			return args[1].Context().Error("runtime", "invalid memory address")
+		}
+
+		if flen < 0 {
+			return args[2].Context().Error("runtime", "invalid length")
+		}
+
+		// Compared against the room left so that a huge length cannot wrap the
+		// end address around.
+		if flen >= int64(len(vm.Memory))-address {
+			return args[2].Context().Error("runtime", fmt.Sprintf("memory out of bounds (%d cells from address %d)", flen, address))
+		}
+
+		data := make([]byte, flen)
+		for i := int64(0); i < flen; i++ {
+			data[i] = byte(vm.Memory[address+i])
+		}
+
+		if err := fsys.WriteFile(args[0].String, data); err != nil {
+			return args[0].Context().Wrap("runtime", err)
+		}
+
+		return nil
+	})
+}
+
+func (vm *VM) registerTTY() {
+	// call vm_no_input_buffering
+	vm.RegisterFunc("vm_no_input_buffering", Signature{}, func(ctx lexer.TokenContext, args []Arg) error {
+		cmd := exec.Command("stty", "-F", "/dev/tty", "cbreak", "min", "1")
+		cmd.Stderr = vm.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return ctx.Wrap("runtime", err)
+		}
+
+		return nil
+	})
+}
+
+func (vm *VM) registerEnv() {
+	// call getenv <name> <addr> <length_var>
+	//
+	// The length is -1 if the variable is not set.
+	vm.RegisterFunc("getenv", Signature{Str("name"), In("addr"), Out("length_var")}, func(ctx lexer.TokenContext, args []Arg) error {
+		value, ok := os.LookupEnv(args[0].String)
+		if !ok {
+			args[2].Var.Set(-1)
+			return nil
+		}
+
+		address := args[1].Int
+		if address < 0 || address+int64(len(value)) > int64(len(vm.Memory)) {
+			return args[1].Context().Error("runtime", "invalid memory address")
+		}
+
+		for i := 0; i < len(value); i++ {
+			vm.Memory[address+int64(i)] = int64(value[i])
+		}
+
+		args[2].Var.Set(int64(len(value)))
+
+		return nil
+	})
+}
+
+func (vm *VM) registerClock() {
+	// call time_ms <var>
+	vm.RegisterFunc("time_ms", Signature{Out("var")}, func(ctx lexer.TokenContext, args []Arg) error {
+		args[0].Var.Set(time.Now().UnixMilli())
+
+		return nil
+	})
+
+	// call sleep_ms <ms>
+	//
+	// Sleeping stops early if the run is cancelled.
+	vm.RegisterFunc("sleep_ms", Signature{In("ms")}, func(ctx lexer.TokenContext, args []Arg) error {
+		timer := time.NewTimer(time.Duration(args[0].Int) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			return nil
+		case <-vm.done:
+			return vm.cancelled(ctx)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGrant(t *testing.T) {
+	tests := []struct {
+		name    string
+		perms   Permissions
+		granted []string
+	}{
+		{"none", Permissions{}, nil},
+		{"fs-read", Permissions{FSRead: Dir(".")}, []string{"read_file"}},
+		{"fs-write", Permissions{FSWrite: Dir(".")}, []string{"write_file"}},
+		{"tty", Permissions{TTY: true}, []string{"vm_no_input_buffering"}},
+		{"env", Permissions{Env: true}, []string{"getenv"}},
+		{"clock", Permissions{Clock: true}, []string{"time_ms", "sleep_ms"}},
+		{"unrestricted", Unrestricted(), []string{"read_file", "write_file", "vm_no_input_buffering", "getenv", "time_ms", "sleep_ms"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+			vm.Grant(test.perms)
+
+			granted := map[string]bool{}
+			for _, name := range test.granted {
+				granted[name] = true
+			}
+
+			for name := range builtinPermissions {
+				if _, ok := vm.Funcs[name]; ok != granted[name] {
+					t.Errorf("%s registered: %t, want %t", name, ok, granted[name])
+				}
+			}
+		})
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "in.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := filepath.Rel(root, filepath.Join(outside, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		perms Permissions
+		code  string
+		err   bool
+		vars  map[string]int64
+	}{
+		{"read denied", Permissions{}, `call read_file "in.txt" 0 n`, true, nil},
+		{"write denied", Permissions{FSRead: Dir(root)}, `call write_file "out.txt" 0 1`, true, nil},
+		{"read", Permissions{FSRead: Dir(root)}, "call read_file \"in.txt\" 0 n\ncall memget 1 c", false, map[string]int64{"n": 2, "c": 'i'}},
+		{"write", Permissions{FSRead: Dir(root), FSWrite: Dir(root)}, "call memset 0 65\ncall write_file \"out.txt\" 0 1\ncall read_file \"out.txt\" 4 n", false, map[string]int64{"n": 1}},
+		{"read parent", Permissions{FSRead: Dir(root)}, `call read_file "` + secret + `" 0 n`, true, nil},
+		{"read absolute", Permissions{FSRead: Dir(root)}, `call read_file "` + filepath.Join(outside, "secret") + `" 0 n`, true, nil},
+		{"read through symlink", Permissions{FSRead: Dir(root)}, `call read_file "link/secret" 0 n`, true, nil},
+		{"write parent", Permissions{FSWrite: Dir(root)}, `call write_file "../escaped" 0 1`, true, nil},
+		{"write through symlink", Permissions{FSWrite: Dir(root)}, `call write_file "link/escaped" 0 1`, true, nil},
+		{"write to read-only file system", Permissions{FSWrite: FromFS(os.DirFS(root))}, `call write_file "out2.txt" 0 1`, true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+			vm.Grant(test.perms)
+
+			err := vm.Exec(compileSource(t, vm, test.code))
+			if test.err != (err != nil) {
+				t.Fatalf("got %v, want an error: %t", err, test.err)
+			}
+
+			for name, want := range test.vars {
+				if got, _ := vm.Variables.Get(name); got != want {
+					t.Errorf("%s = %d, want %d", name, got, want)
+				}
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("files outside the root changed: %v, %v", entries, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "out2.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("read-only file system was written to: %v", err)
+	}
+}
+
+func TestDeniedBuiltin(t *testing.T) {
+	vm := New(16)
+
+	err := vm.Exec(compileSource(t, vm, "call getenv \"HOME\" 0 n"))
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("got %v, want %v", err, ErrPermissionDenied)
+	}
+
+	if perm, ok := PermissionFor("getenv"); !ok || perm != PermEnv {
+		t.Fatalf("PermissionFor(getenv) = %q, %t", perm, ok)
+	}
+
+	if _, ok := PermissionFor("shown"); ok {
+		t.Fatal("shown needs no permission")
+	}
+}
+
+// A length running past the end of memory is reported, even one so large that
+// the end address would wrap around.
+func TestWriteFileBounds(t *testing.T) {
+	for _, code := range []string{
+		`call write_file "out.txt" 8 8`,
+		`call write_file "out.txt" 1 9223372036854775807`,
+	} {
+		vm := New(16)
+		vm.Grant(Permissions{FSWrite: Dir(t.TempDir())})
+
+		err := vm.Exec(compileSource(t, vm, code))
+		if err == nil || !strings.Contains(err.Error(), "memory out of bounds") {
+			t.Errorf("%s: got %v, want a bounds error", code, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"sort"
+	"strings"
+)
+
+// Variables holds the global variables of a VM. Compiled code addresses them
+// by slot; the host reads and writes them by name.
+type Variables struct {
+	slots   map[string]int
+	names   []string
+	values  []int64
+	defined []bool
+
+	// count is the number of defined variables that count towards
+	// VM.MaxVariables, which leaves out generated ones.
+	count int
+}
+
+func newVariables() *Variables {
+	return &Variables{
+		slots: make(map[string]int),
+	}
+}
+
+func (v *Variables) slot(name string) int {
+	slot, ok := v.slots[name]
+	if !ok {
+		slot = len(v.names)
+		v.slots[name] = slot
+		v.names = append(v.names, name)
+		v.values = append(v.values, 0)
+		v.defined = append(v.defined, false)
+	}
+
+	return slot
+}
+
+func (v *Variables) Get(name string) (int64, bool) {
+	slot, ok := v.slots[name]
+	if !ok || !v.defined[slot] {
+		return 0, false
+	}
+
+	return v.values[slot], true
+}
+
+func (v *Variables) Set(name string, val int64) {
+	slot := v.slot(name)
+
+	v.values[slot] = val
+	v.define(slot)
+}
+
+func (v *Variables) Delete(name string) {
+	if slot, ok := v.slots[name]; ok && v.defined[slot] {
+		v.values[slot] = 0
+		v.defined[slot] = false
+
+		if counted(name) {
+			v.count--
+		}
+	}
+}
+
+// define marks a slot as holding a value. It reports whether that added to
+// the count of variables.
+func (v *Variables) define(slot int) bool {
+	if v.defined[slot] {
+		return false
+	}
+
+	v.defined[slot] = true
+
+	if !counted(v.names[slot]) {
+		return false
+	}
+
+	v.count++
+
+	return true
+}
+
+// counted reports whether a variable counts towards VM.MaxVariables. Those
+// generated for the VM's own use, such as __memsize, do not.
+func counted(name string) bool {
+	return !strings.HasPrefix(name, "__")
+}
+
+// Names returns the names of all defined variables in sorted order.
+func (v *Variables) Names() []string {
+	names := []string{}
+
+	for slot, name := range v.names {
+		if v.defined[slot] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Map returns a copy of all defined variables.
+func (v *Variables) Map() map[string]int64 {
+	vars := make(map[string]int64, len(v.names))
+
+	for slot, name := range v.names {
+		if v.defined[slot] {
+			vars[name] = v.values[slot]
+		}
+	}
+
+	return vars
+}
+
+// layout reorders the slots so that the given names occupy the first slots,
+// matching the global slot numbers of a compiled program. Values are kept.
+func (v *Variables) layout(names []string) {
+	old := *v
+	*v = *newVariables()
+
+	for _, name := range names {
+		v.slot(name)
+	}
+
+	for slot, name := range old.names {
+		if old.defined[slot] {
+			v.Set(name, old.values[slot])
+		}
+	}
+}
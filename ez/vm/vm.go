@@ -1,505 +1,688 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"os/exec"
 	"strconv"
 
 	"github.com/vcokltfre/ez/ez/lexer"
 	"github.com/vcokltfre/ez/ez/parser"
 )
 
-type ExternalFunc struct {
-	ArgCount    int
-	ArgValidate bool
-	Fn          func(lexer.TokenContext, ...parser.Value) error
-}
-
 type VM struct {
 	Memory    []int64
-	Variables map[string]int64
+	Variables *Variables
 	Funcs     map[string]ExternalFunc
+	MaxDepth  int
+	Stdin     io.Reader
+	Stdout    io.Writer
+	Stderr    io.Writer
+
+	// MaxSteps, if positive, is the number of instructions a run may execute.
+	MaxSteps int64
+
+	// MaxVariables, if positive, limits the variables that exist at once: the
+	// defined globals plus the locals of every active function call. Generated
+	// variables, whose names start with "__", are not counted. MaxMemory limits
+	// those together with the cells of Memory.
+	MaxVariables int
+	MaxMemory    int
+
+	// Hook, if set, is called before each statement runs with the offset of its
+	// first instruction. Returning an error stops execution with that error.
+	Hook func(pc int) error
+
+	code   *Code
+	pc     int
+	steps  int64
+	ctx    context.Context
+	done   <-chan struct{}
+	nlocal int
+	stack  []int64
+	frames []Frame
+	serial uint64
+
+	fn      *Function
+	locals  []int64
+	defined []bool
+
+	// top is the scope of the top level, entered when no function is active.
+	top Frame
+}
 
-	program *parser.Program
-	jumps   map[string]int
-	index   int
+func (vm *VM) push(val int64) {
+	vm.stack = append(vm.stack, val)
 }
 
-func (vm *VM) setValue(stmt parser.VarDeclValue) error {
-	if stmt.Value.Type == parser.ValueTypeInt {
-		vm.Variables[stmt.Name], _ = strconv.ParseInt(stmt.Value.Value, 10, 64)
-		return nil
-	}
+func (vm *VM) pop() int64 {
+	val := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
 
-	val, ok := vm.Variables[stmt.Value.Value]
-	if !ok {
-		return stmt.Value.Token.Context.Error("runtime", "variable does not exist")
+	return val
+}
+
+// binary applies an arithmetic, bitwise or comparison opcode. Comparisons
+// yield 0 or 1. Addition, subtraction and multiplication wrap around like
+// int64 does; division and powers that cannot give a correct int64 fail.
+func binary(op Opcode, lhs, rhs int64) (int64, error) {
+	switch op {
+	case OpAdd:
+		return lhs + rhs, nil
+	case OpSub:
+		return lhs - rhs, nil
+	case OpMul:
+		return lhs * rhs, nil
+	case OpDiv:
+		if rhs == 0 {
+			return 0, ErrDivisionByZero
+		}
+
+		if lhs == math.MinInt64 && rhs == -1 {
+			return 0, ErrOverflow
+		}
+
+		return lhs / rhs, nil
+	case OpMod:
+		if rhs == 0 {
+			return 0, ErrDivisionByZero
+		}
+
+		return lhs % rhs, nil
+	case OpPow:
+		return power(lhs, rhs)
+	case OpAnd:
+		return lhs & rhs, nil
+	case OpOr:
+		return lhs | rhs, nil
+	case OpXor:
+		return lhs ^ rhs, nil
+	case OpShl, OpShr, OpUshr:
+		if rhs < 0 {
+			return 0, errors.New("negative shift count")
+		}
+
+		switch op {
+		case OpShl:
+			return lhs << rhs, nil
+		case OpShr:
+			return lhs >> rhs, nil
+		default:
+			return int64(uint64(lhs) >> rhs), nil
+		}
 	}
 
-	vm.Variables[stmt.Name] = val
+	switch op {
+	case OpEq:
+		return truth(lhs == rhs), nil
+	case OpNe:
+		return truth(lhs != rhs), nil
+	case OpLt:
+		return truth(lhs < rhs), nil
+	case OpGt:
+		return truth(lhs > rhs), nil
+	case OpLe:
+		return truth(lhs <= rhs), nil
+	case OpGe:
+		return truth(lhs >= rhs), nil
+	}
 
-	return nil
+	return 0, fmt.Errorf("invalid opcode: %d", op)
 }
 
-func (vm *VM) setValueFromOp(stmt parser.VarDeclExpr) error {
-	var lhs int64
-	if stmt.Expr.Lhs.Type == parser.ValueTypeInt {
-		lhs, _ = strconv.ParseInt(stmt.Expr.Lhs.Value, 10, 64)
-	} else {
-		val, ok := vm.Variables[stmt.Expr.Lhs.Value]
-		if !ok {
-			return stmt.Expr.Lhs.Token.Context.Error("runtime", "variable does not exist")
-		}
+func truth(b bool) int64 {
+	if b {
+		return 1
+	}
 
-		lhs = val
+	return 0
+}
+
+// power raises base to a non-negative exponent by squaring, failing instead of
+// wrapping around if the result does not fit.
+func power(base, exp int64) (int64, error) {
+	if exp < 0 {
+		return 0, errors.New("negative exponent")
 	}
 
-	var rhs int64
-	if stmt.Expr.Rhs.Type == parser.ValueTypeInt {
-		rhs, _ = strconv.ParseInt(stmt.Expr.Rhs.Value, 10, 64)
-	} else {
-		val, ok := vm.Variables[stmt.Expr.Rhs.Value]
-		if !ok {
-			return stmt.Expr.Rhs.Token.Context.Error("runtime", "variable does not exist")
+	result := int64(1)
+
+	var ok bool
+
+	for exp > 0 {
+		if exp&1 == 1 {
+			if result, ok = multiply(result, base); !ok {
+				return 0, ErrOverflow
+			}
 		}
 
-		rhs = val
+		exp >>= 1
+
+		if exp > 0 {
+			if base, ok = multiply(base, base); !ok {
+				return 0, ErrOverflow
+			}
+		}
 	}
 
-	switch stmt.Expr.Op {
-	case "+":
-		vm.Variables[stmt.Name] = lhs + rhs
-	case "-":
-		vm.Variables[stmt.Name] = lhs - rhs
-	case "*":
-		vm.Variables[stmt.Name] = lhs * rhs
-	case "/":
-		vm.Variables[stmt.Name] = lhs / rhs
-	case "%":
-		vm.Variables[stmt.Name] = lhs % rhs
-	default:
-		panic("invalid operator: " + stmt.Expr.Op)
+	return result, nil
+}
+
+func multiply(a, b int64) (int64, bool) {
+	c := a * b
+	if a != 0 && (c/a != b || a == -1 && b == math.MinInt64) {
+		return 0, false
 	}
 
-	return nil
+	return c, true
 }
 
-func (vm *VM) ifStmt(stmt parser.If) error {
-	var lhs int64
-	if stmt.Cond.Lhs.Type == parser.ValueTypeInt {
-		lhs, _ = strconv.ParseInt(stmt.Cond.Lhs.Value, 10, 64)
-	} else {
-		val, ok := vm.Variables[stmt.Cond.Lhs.Value]
+func (vm *VM) value(val parser.Value) (int64, error) {
+	switch val.Type {
+	case parser.ValueTypeInt:
+		result, err := strconv.ParseInt(val.Value, 10, 64)
+		if err != nil {
+			return 0, val.Token.Error("runtime", "integer literal out of range")
+		}
+
+		return result, nil
+	case parser.ValueTypeVar:
+		result, ok := vm.getVar(val.Value)
 		if !ok {
-			return stmt.Cond.Lhs.Token.Context.Error("runtime", "variable does not exist")
+			return 0, val.Token.Error("runtime", "variable does not exist")
 		}
 
-		lhs = val
+		return result, nil
 	}
 
-	var rhs int64
-	if stmt.Cond.Rhs.Type == parser.ValueTypeInt {
-		rhs, _ = strconv.ParseInt(stmt.Cond.Rhs.Value, 10, 64)
-	} else {
-		val, ok := vm.Variables[stmt.Cond.Rhs.Value]
+	return 0, val.Token.Error("runtime", "expected identifier or literal int not literal str")
+}
+
+// eval evaluates a builtin argument directly from the syntax tree, resolving
+// variables by name in the current scope.
+func (vm *VM) eval(expr parser.Expr) (int64, error) {
+	switch expr.Kind() {
+	case parser.ExprKindValue:
+		return vm.value(expr.(parser.Value))
+	case parser.ExprKindUnary:
+		unary := expr.(parser.UnaryExpr)
+
+		operand, err := vm.eval(unary.Operand)
+		if err != nil {
+			return 0, err
+		}
+
+		switch unary.Op {
+		case "-":
+			return -operand, nil
+		case "~":
+			return ^operand, nil
+		case "not":
+			return truth(operand == 0), nil
+		default:
+			return 0, unary.Token.Error("runtime", "unsupported operator: "+unary.Op)
+		}
+	case parser.ExprKindBinary:
+		expr := expr.(parser.BinaryExpr)
+
+		lhs, err := vm.eval(expr.Lhs)
+		if err != nil {
+			return 0, err
+		}
+
+		// and/or only evaluate the right hand side if they have to.
+		if expr.Op == "and" && lhs == 0 || expr.Op == "or" && lhs != 0 {
+			return truth(lhs != 0), nil
+		}
+
+		rhs, err := vm.eval(expr.Rhs)
+		if err != nil {
+			return 0, err
+		}
+
+		if expr.Op == "and" || expr.Op == "or" {
+			return truth(rhs != 0), nil
+		}
+
+		op, ok := binaryOps[expr.Op]
 		if !ok {
-			return stmt.Cond.Rhs.Token.Context.Error("runtime", "variable does not exist")
+			return 0, expr.Token.Error("runtime", "unsupported operator: "+expr.Op)
+		}
+
+		result, err := binary(op, lhs, rhs)
+		if err != nil {
+			return 0, expr.Token.Context.Wrap("runtime", err)
+		}
+
+		return result, nil
+	case parser.ExprKindCall:
+		call := expr.(parser.CallExpr)
+
+		index := -1
+		for i, fn := range vm.code.Funcs {
+			if fn.Name == call.Name {
+				index = i
+			}
 		}
 
-		rhs = val
+		if index == -1 {
+			return 0, vm.noFunc(call.Name, call.Token.Context)
+		}
+
+		return vm.invoke(index, call.Args, call.Token.Context)
 	}
 
-	var result bool
-	switch stmt.Cond.Op {
-	case "==":
-		result = lhs == rhs
-	case "!=":
-		result = lhs != rhs
-	case ">":
-		result = lhs > rhs
-	case "<":
-		result = lhs < rhs
-	case ">=":
-		result = lhs >= rhs
-	case "<=":
-		result = lhs <= rhs
-	default:
-		panic("invalid operator: " + stmt.Cond.Op)
+	return 0, expr.Context().Error("runtime", "invalid expression: "+string(expr.Kind()))
+}
+
+// invoke calls a user-defined function from Go and runs it to completion.
+// On an error it drops the frames and values the call left behind, so the
+// program it interrupted can still be resumed.
+func (vm *VM) invoke(index int, args []parser.Expr, ctx lexer.TokenContext) (val int64, err error) {
+	fn := vm.code.Funcs[index]
+
+	if len(args) != fn.Params {
+		return 0, ctx.Error("runtime", fmt.Sprintf("incorrect number of arguments (expected %d, got %d)", fn.Params, len(args)))
 	}
 
-	if result {
-		if _, ok := vm.jumps[stmt.Goto.Name]; !ok {
-			return stmt.Goto.Token.Context.Error("runtime", "label does not exist")
+	depth, stack, nlocal, returnTo := len(vm.frames), len(vm.stack), vm.nlocal, vm.pc
+
+	defer func() {
+		vm.pc = returnTo
+
+		if err != nil {
+			vm.frames, vm.stack, vm.nlocal = vm.frames[:min(depth, len(vm.frames))], vm.stack[:min(stack, len(vm.stack))], nlocal
+			vm.enterScope()
+		}
+	}()
+
+	for _, arg := range args {
+		val, err := vm.eval(arg)
+		if err != nil {
+			return 0, err
 		}
 
-		vm.index = vm.jumps[stmt.Goto.Name]
+		vm.push(val)
 	}
 
-	return nil
+	if err := vm.callFunc(index, ctx); err != nil {
+		return 0, err
+	}
+
+	if err := vm.exec(depth + 1); err != nil {
+		return 0, err
+	}
+
+	return vm.pop(), nil
 }
 
-func (vm *VM) goTo(stmt parser.Goto) error {
-	if _, ok := vm.jumps[stmt.Name]; !ok {
-		return stmt.Token.Context.Error("runtime", "label does not exist")
+func (vm *VM) noFunc(name string, ctx lexer.TokenContext) error {
+	if _, ok := vm.Funcs[name]; ok {
+		return ctx.Error("runtime", "builtin functions do not return a value", "Use 'call' to run builtin functions")
 	}
 
-	vm.index = vm.jumps[stmt.Name]
+	if err := denied(name, ctx); err != nil {
+		return err
+	}
 
-	return nil
+	return ctx.Error("runtime", "function does not exist")
 }
 
-func (vm *VM) call(stmt parser.Call) error {
-	callFn, ok := vm.Funcs[stmt.Name]
+func (vm *VM) callBuiltin(call BuiltinCall) error {
+	callFn, ok := vm.Funcs[call.Name]
 	if !ok {
-		return stmt.Token.Context.Error("runtime", "function does not exist")
+		if err := denied(call.Name, call.Token.Context); err != nil {
+			return err
+		}
+
+		return call.Token.Error("runtime", "function does not exist")
 	}
 
-	if len(stmt.Values) != callFn.ArgCount && callFn.ArgCount != -1 {
-		return stmt.Token.Context.Error("runtime", "incorrect number of arguments")
+	if call.Err != nil {
+		return call.Err
 	}
 
-	if callFn.ArgValidate {
-		for _, val := range stmt.Values {
-			if val.Type == parser.ValueTypeVar {
-				if _, ok := vm.Variables[val.Value]; !ok {
-					return val.Token.Context.Error("runtime", "variable does not exist")
-				}
-			}
-		}
+	if !callFn.Signature.equal(call.Signature) {
+		return call.Token.Error("runtime", "builtin signature changed since the program was compiled")
 	}
 
-	return callFn.Fn(stmt.Token.Context, stmt.Values...)
-}
+	args := vm.resolve(call)
+
+	// Host functions may return plain errors, which are reported at the call.
+	if err := callFn.Fn(call.Token.Context, args); err != nil {
+		var diag lexer.Diagnostic
+		if errors.As(err, &diag) {
+			return err
+		}
 
-func (vm *VM) RegisterFunc(name string, argCount int, argValidate bool, fn func(lexer.TokenContext, ...parser.Value) error) {
-	vm.Funcs[name] = ExternalFunc{
-		ArgCount:    argCount,
-		ArgValidate: argValidate,
-		Fn:          fn,
+		return call.Token.Context.Wrap("runtime", err)
 	}
+
+	// Builtins create variables through their output arguments.
+	return vm.quota(call.Token.Context)
 }
 
-func (vm *VM) Run(program *parser.Program) error {
-	vm.program = program
+// exec runs instructions until the program halts or the call stack drops below depth.
+func (vm *VM) exec(depth int) error {
+	code := vm.code
+	globals := vm.Variables
+	limited := vm.MaxSteps > 0 || vm.done != nil
 
-	for i, stmt := range vm.program.Stmts {
-		if stmt.Type() == parser.StmtTypeLabel {
-			vm.jumps[stmt.(parser.Label).Name] = i
+	for vm.pc < len(code.Instrs) {
+		if vm.Hook != nil && code.Stmts[vm.pc] {
+			if err := vm.Hook(vm.pc); err != nil {
+				return err
+			}
 		}
-	}
-
-	for vm.index < len(vm.program.Stmts) {
-		stmt := vm.program.Stmts[vm.index]
 
-		switch stmt.Type() {
-		case parser.StmtTypeVarDeclValue:
-			err := vm.setValue(stmt.(parser.VarDeclValue))
-			if err != nil {
+		if limited {
+			if err := vm.step(); err != nil {
 				return err
 			}
-		case parser.StmtTypeVarDeclExpr:
-			err := vm.setValueFromOp(stmt.(parser.VarDeclExpr))
+		}
+
+		instr := code.Instrs[vm.pc]
+		vm.pc++
+
+		switch instr.Op {
+		case OpConst:
+			vm.push(instr.Arg)
+		case OpLoadGlobal:
+			if !globals.defined[instr.Arg] {
+				return code.Contexts[vm.pc-1].Error("runtime", "variable does not exist")
+			}
+
+			vm.push(globals.values[instr.Arg])
+		case OpLoadLocal:
+			if !vm.defined[instr.Arg] {
+				return code.Contexts[vm.pc-1].Error("runtime", "variable does not exist")
+			}
+
+			vm.push(vm.locals[instr.Arg])
+		case OpStoreGlobal:
+			globals.values[instr.Arg] = vm.pop()
+
+			if globals.define(int(instr.Arg)) {
+				if err := vm.quota(code.Contexts[vm.pc-1]); err != nil {
+					return err
+				}
+			}
+		case OpStoreLocal:
+			vm.locals[instr.Arg] = vm.pop()
+			vm.defined[instr.Arg] = true
+		case OpPop:
+			vm.pop()
+		case OpIncGlobal:
+			if !globals.defined[instr.Arg] {
+				return code.Contexts[vm.pc-1].Error("runtime", "variable does not exist")
+			}
+
+			globals.values[instr.Arg] += vm.pop()
+		case OpIncLocal:
+			if !vm.defined[instr.Arg] {
+				return code.Contexts[vm.pc-1].Error("runtime", "variable does not exist")
+			}
+
+			vm.locals[instr.Arg] += vm.pop()
+		case OpNeg:
+			vm.stack[len(vm.stack)-1] = -vm.stack[len(vm.stack)-1]
+		case OpBitNot:
+			vm.stack[len(vm.stack)-1] = ^vm.stack[len(vm.stack)-1]
+		case OpNot:
+			vm.stack[len(vm.stack)-1] = truth(vm.stack[len(vm.stack)-1] == 0)
+		case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow, OpAnd, OpOr, OpXor, OpShl, OpShr, OpUshr, OpEq, OpNe, OpLt, OpGt, OpLe, OpGe:
+			rhs := vm.pop()
+
+			result, err := binary(instr.Op, vm.stack[len(vm.stack)-1], rhs)
 			if err != nil {
+				return code.Contexts[vm.pc-1].Wrap("runtime", err)
+			}
+
+			vm.stack[len(vm.stack)-1] = result
+		case OpJump:
+			vm.pc = int(instr.Arg)
+		case OpJumpTrue:
+			if vm.pop() != 0 {
+				vm.pc = int(instr.Arg)
+			}
+		case OpCall:
+			if err := vm.callFunc(int(instr.Arg), code.Contexts[vm.pc-1]); err != nil {
 				return err
 			}
-		case parser.StmtTypeIf:
-			err := vm.ifStmt(stmt.(parser.If))
-			if err != nil {
+		case OpReturn:
+			if err := vm.returnFrom(code.Contexts[vm.pc-1]); err != nil {
 				return err
 			}
-		case parser.StmtTypeLabel:
-		case parser.StmtTypeGoto:
-			err := vm.goTo(stmt.(parser.Goto))
-			if err != nil {
+
+			if len(vm.frames) < depth {
+				return nil
+			}
+		case OpGosub:
+			if err := vm.gosub(int(instr.Arg), code.Contexts[vm.pc-1]); err != nil {
 				return err
 			}
-		case parser.StmtTypeCall:
-			err := vm.call(stmt.(parser.Call))
-			if err != nil {
+		case OpBuiltin:
+			if err := vm.callBuiltin(code.Calls[instr.Arg]); err != nil {
 				return err
 			}
+		case OpNoFunc:
+			call := code.Calls[instr.Arg]
+			return vm.noFunc(call.Name, call.Token.Context)
+		case OpFail:
+			return code.Contexts[vm.pc-1].Error("runtime", code.Messages[instr.Arg])
+		case OpHalt:
+			return nil
 		}
-
-		vm.index++
 	}
 
 	return nil
 }
 
-func denyStringType(vals ...parser.Value) error {
-	for _, val := range vals {
-		if val.Type == parser.ValueTypeStr {
-			return val.Token.Context.Error("runtime", "expected identifier or literal int not literal str")
-		}
-	}
+// Exec runs compiled code. The global variables are laid out to match the
+// code's slots, keeping any values the host has already set.
+func (vm *VM) Exec(code *Code) error {
+	return vm.execFrom(context.Background(), code, 0)
+}
 
-	return nil
+// ExecContext runs compiled code until it finishes or ctx is done, in which
+// case ErrCancelled or ErrTimeout is returned. Builtins that block, such as
+// input, are not interrupted.
+func (vm *VM) ExecContext(ctx context.Context, code *Code) error {
+	return vm.execFrom(ctx, code, 0)
 }
 
-func New(memsize int) *VM {
-	vm := &VM{
-		Memory:    make([]int64, memsize),
-		Variables: make(map[string]int64),
-		Funcs:     make(map[string]ExternalFunc),
+// ExecFrom runs compiled code starting at the given instruction offset.
+func (vm *VM) ExecFrom(code *Code, pc int) error {
+	return vm.execFrom(context.Background(), code, pc)
+}
 
-		jumps: make(map[string]int),
+// execFrom runs code from pc. A panic in a host function is returned as a
+// runtime error at the statement that called it.
+func (vm *VM) execFrom(ctx context.Context, code *Code, pc int) (err error) {
+	vm.code = code
+	vm.pc = pc
+	vm.steps = 0
+	vm.ctx, vm.done = ctx, ctx.Done()
+	vm.stack = vm.stack[:0]
+	vm.Variables.layout(code.Globals)
+
+	if code.Main != nil {
+		vm.top = Frame{fn: code.Main, locals: make([]int64, len(code.Main.Locals)), defined: make([]bool, len(code.Main.Locals))}
+	} else {
+		vm.top = Frame{}
 	}
+	vm.enterScope()
 
-	// call showc <var>
-	vm.RegisterFunc("showc", 1, true, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args...); err != nil {
-			return err
-		}
-
-		var val int64
-		if args[0].Type == parser.ValueTypeInt {
-			val, _ = strconv.ParseInt(args[0].Value, 10, 64)
-		} else {
-			var ok bool
-			val, ok = vm.Variables[args[0].Value]
-			if !ok {
-				return args[0].Token.Context.Error("runtime", "variable does not exist")
-			}
+	defer func() {
+		if r := recover(); r != nil {
+			err = vm.withTrace(code.Contexts[max(vm.pc-1, 0)].Error("runtime", fmt.Sprintf("panic: %v", r)))
 		}
+	}()
 
-		fmt.Printf("%c", byte(val))
+	start := code.Contexts[min(pc, len(code.Contexts)-1)]
 
-		return nil
-	})
+	if err := vm.quota(start); err != nil {
+		return err
+	}
 
-	// call shown <var>
-	vm.RegisterFunc("shown", 1, true, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args...); err != nil {
+	if vm.done != nil {
+		if err := vm.cancelled(start); err != nil {
 			return err
 		}
+	}
 
-		var val int64
-		if args[0].Type == parser.ValueTypeInt {
-			val, _ = strconv.ParseInt(args[0].Value, 10, 64)
-		} else {
-			var ok bool
-			val, ok = vm.Variables[args[0].Value]
-			if !ok {
-				return args[0].Token.Context.Error("runtime", "variable does not exist")
-			}
-		}
+	if err := vm.exec(0); err != nil {
+		return vm.withTrace(err)
+	}
 
-		fmt.Printf("%d", val)
+	return nil
+}
 
-		return nil
-	})
+// step counts an instruction against the step limit. Cancellation is only
+// polled now and then as it costs a channel check.
+func (vm *VM) step() error {
+	vm.steps++
 
-	// call input <var>
-	vm.RegisterFunc("input", 1, false, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args...); err != nil {
+	if vm.steps&1023 == 0 && vm.done != nil {
+		if err := vm.cancelled(vm.code.Contexts[vm.pc]); err != nil {
 			return err
 		}
+	}
 
-		if args[0].Type != parser.ValueTypeVar {
-			return args[0].Token.Context.Error("runtime", "expected identifier not literal")
-		}
-
-		char := make([]byte, 1)
-		_, err := os.Stdin.Read(char)
-		if err != nil {
-			panic(err)
-		}
+	if vm.MaxSteps > 0 && vm.steps > vm.MaxSteps {
+		return vm.code.Contexts[vm.pc].Wrap("runtime", ErrStepLimit)
+	}
 
-		vm.Variables[args[0].Value] = int64(char[0])
+	return nil
+}
 
+// cancelled returns an error if the context of the run is done.
+func (vm *VM) cancelled(ctx lexer.TokenContext) error {
+	select {
+	case <-vm.done:
+	default:
 		return nil
-	})
-
-	// call memset <addr> <value>
-	vm.RegisterFunc("memset", 2, true, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args...); err != nil {
-			return err
-		}
+	}
 
-		var addr int64
-		if args[0].Type == parser.ValueTypeInt {
-			addr, _ = strconv.ParseInt(args[0].Value, 10, 64)
-		} else {
-			addr = vm.Variables[args[0].Value]
-		}
+	if errors.Is(vm.ctx.Err(), context.DeadlineExceeded) {
+		return ctx.Wrap("runtime", fmt.Errorf("%w (%w)", ErrTimeout, vm.ctx.Err()))
+	}
 
-		if addr < 0 || addr >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", "invalid memory address")
-		}
+	return ctx.Wrap("runtime", fmt.Errorf("%w (%w)", ErrCancelled, vm.ctx.Err()))
+}
 
-		var val int64
-		if args[1].Type == parser.ValueTypeInt {
-			val, _ = strconv.ParseInt(args[1].Value, 10, 64)
-		} else {
-			val = vm.Variables[args[1].Value]
-		}
+// quota returns an error if the variables or memory in use are over the limits.
+func (vm *VM) quota(ctx lexer.TokenContext) error {
+	vars := vm.Variables.count + vm.nlocal
 
-		vm.Memory[addr] = val
+	if vm.MaxVariables > 0 && vars > vm.MaxVariables {
+		return ctx.Wrap("runtime", fmt.Errorf("%w (%d variables)", ErrVariableQuota, vm.MaxVariables))
+	}
 
-		return nil
-	})
+	if vm.MaxMemory > 0 && vars+len(vm.Memory) > vm.MaxMemory {
+		return ctx.Wrap("runtime", fmt.Errorf("%w (%d cells)", ErrMemoryQuota, vm.MaxMemory))
+	}
 
-	// call memget <addr> <var>
-	vm.RegisterFunc("memget", 2, false, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args...); err != nil {
-			return err
-		}
+	return nil
+}
 
-		var addr int64
-		if args[0].Type == parser.ValueTypeInt {
-			addr, _ = strconv.ParseInt(args[0].Value, 10, 64)
-		} else {
-			var ok bool
-			addr, ok = vm.Variables[args[0].Value]
-			if !ok {
-				return args[0].Token.Context.Error("runtime", "variable does not exist")
-			}
-		}
+func (vm *VM) Run(program *parser.Program) error {
+	return vm.Exec(Compile(program, vm.Funcs))
+}
 
-		if addr < 0 || addr >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", "invalid memory address")
-		}
+// RunContext compiles and runs a program, stopping when ctx is done.
+func (vm *VM) RunContext(ctx context.Context, program *parser.Program) error {
+	return vm.ExecContext(ctx, Compile(program, vm.Funcs))
+}
 
-		if args[1].Type != parser.ValueTypeVar {
-			return args[1].Token.Context.Error("runtime", "expected identifier not literal")
-		}
+func New(memsize int) *VM {
+	vm := &VM{
+		Memory:    make([]int64, memsize),
+		Variables: newVariables(),
+		Funcs:     make(map[string]ExternalFunc),
+		MaxDepth:  DefaultMaxDepth,
+		Stdin:     os.Stdin,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+	}
 
-		vm.Variables[args[1].Value] = vm.Memory[addr]
+	// call showc <expr>
+	vm.RegisterFunc("showc", Signature{In("char")}, func(ctx lexer.TokenContext, args []Arg) error {
+		fmt.Fprintf(vm.Stdout, "%c", byte(args[0].Int))
 
 		return nil
 	})
 
-	// call debug ...vars
-	vm.RegisterFunc("debug", -1, true, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		for _, arg := range args {
-			if arg.Type == parser.ValueTypeStr {
-				fmt.Printf("Debug: %s (str): %s\n", arg.Value, arg.Value)
-				continue
-			}
-
-			var val int64
-			if arg.Type == parser.ValueTypeInt {
-				val, _ = strconv.ParseInt(arg.Value, 10, 64)
-			} else {
-				val = vm.Variables[arg.Value]
-			}
-			fmt.Printf("Debug: %s (%s): %d\n", arg.Value, arg.Type, val)
-		}
+	// call shown <expr>
+	vm.RegisterFunc("shown", Signature{In("number")}, func(ctx lexer.TokenContext, args []Arg) error {
+		fmt.Fprintf(vm.Stdout, "%d", args[0].Int)
 
 		return nil
 	})
 
-	// call vm_no_input_buffering
-	vm.RegisterFunc("vm_no_input_buffering", 0, false, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		return exec.Command("stty", "-F", "/dev/tty", "cbreak", "min", "1").Run()
-	})
-
-	// call read_file <filename> <addr> <length_var>
-	vm.RegisterFunc("read_file", 3, false, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args[1:]...); err != nil {
-			return err
-		}
-
-		file, addr, length := args[0], args[1], args[2]
-
-		if file.Type != parser.ValueTypeStr {
-			return file.Token.Context.Error("runtime", "expected string literal")
-		}
-
-		if length.Type != parser.ValueTypeVar {
-			return length.Token.Context.Error("runtime", "expected identifier")
-		}
-
-		var address int64
-		if addr.Type == parser.ValueTypeInt {
-			address, _ = strconv.ParseInt(addr.Value, 10, 64)
-		} else {
-			var ok bool
-			address, ok = vm.Variables[addr.Value]
-			if !ok {
-				return addr.Token.Context.Error("runtime", "variable does not exist")
-			}
-		}
-
-		if address < 0 || address >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", "invalid memory address")
+	// call input <var>
+	vm.RegisterFunc("input", Signature{Out("var")}, func(ctx lexer.TokenContext, args []Arg) error {
+		// At the end of input the variable is set to -1, which no byte can be.
+		char := make([]byte, 1)
+		if _, err := io.ReadFull(vm.Stdin, char); errors.Is(err, io.EOF) {
+			args[0].Var.Set(-1)
+			return nil
+		} else if err != nil {
+			return ctx.Wrap("runtime", err)
 		}
 
-		data, err := os.ReadFile(file.Value)
-		if err != nil {
-			return file.Token.Context.Error("runtime", err.Error())
-		}
+		args[0].Var.Set(int64(char[0]))
 
-		if address+int64(len(data)) >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", "file too large")
-		}
+		return nil
+	})
 
-		for i, b := range data {
-			vm.Memory[address+int64(i)] = int64(b)
+	// call memset <addr> <value>
+	vm.RegisterFunc("memset", Signature{In("addr"), In("value")}, func(ctx lexer.TokenContext, args []Arg) error {
+		addr := args[0].Int
+		if addr < 0 || addr >= int64(len(vm.Memory)) {
+			return args[0].Context().Error("runtime", "invalid memory address")
 		}
 
-		vm.Variables[length.Value] = int64(len(data))
+		vm.Memory[addr] = args[1].Int
 
 		return nil
 	})
 
-	// call write_file <filename> <addr> <length>
-	vm.RegisterFunc("write_file", 3, false, func(ctx lexer.TokenContext, args ...parser.Value) error {
-		if err := denyStringType(args[1:]...); err != nil {
-			return err
+	// call memget <addr> <var>
+	vm.RegisterFunc("memget", Signature{In("addr"), Out("var")}, func(ctx lexer.TokenContext, args []Arg) error {
+		addr := args[0].Int
+		if addr < 0 || addr >= int64(len(vm.Memory)) {
+			return args[0].Context().Error("runtime", "invalid memory address")
 		}
 
-		file, addr, length := args[0], args[1], args[2]
+		args[1].Var.Set(vm.Memory[addr])
 
-		if file.Type != parser.ValueTypeStr {
-			return file.Token.Context.Error("runtime", "expected string literal")
-		}
+		return nil
+	})
 
-		var address int64
-		if addr.Type == parser.ValueTypeInt {
-			address, _ = strconv.ParseInt(addr.Value, 10, 64)
-		} else {
-			var ok bool
-			address, ok = vm.Variables[addr.Value]
-			if !ok {
-				return addr.Token.Context.Error("runtime", "variable does not exist")
+	// call debug ...exprs
+	vm.RegisterFunc("debug", Signature{Any("value").Opt().Many()}, func(ctx lexer.TokenContext, args []Arg) error {
+		for _, arg := range args {
+			if arg.IsString {
+				fmt.Fprintf(vm.Stdout, "Debug: %s (str): %s\n", arg.String, arg.String)
+				continue
 			}
-		}
-
-		if address < 0 || address >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", "invalid memory address")
-		}
 
-		var flen int64
-		if length.Type == parser.ValueTypeInt {
-			flen, _ = strconv.ParseInt(length.Value, 10, 64)
-		} else {
-			var ok bool
-			flen, ok = vm.Variables[length.Value]
-			if !ok {
-				return length.Token.Context.Error("runtime", "variable does not exist")
+			if val, ok := arg.Expr.(parser.Value); ok {
+				fmt.Fprintf(vm.Stdout, "Debug: %s (%s): %d\n", val.Value, val.Type, arg.Int)
+				continue
 			}
-		}
-
-		if address+flen >= int64(len(vm.Memory)) {
-			return ctx.Error("runtime", fmt.Sprintf("memory out of bounds (%d)", address+flen))
-		}
 
-		data := make([]byte, flen)
-		for i := int64(0); i < flen; i++ {
-			data[i] = byte(vm.Memory[address+i])
-		}
-
-		err := os.WriteFile(file.Value, data, 0644)
-		if err != nil {
-			return file.Token.Context.Error("runtime", err.Error())
+			fmt.Fprintf(vm.Stdout, "Debug: %s (%s): %d\n", arg.Expr, arg.Expr.Kind(), arg.Int)
 		}
 
 		return nil
 	})
 
-	vm.Variables["__memsize"] = int64(memsize)
+	vm.Variables.Set("__memsize", int64(memsize))
 
 	return vm
 }
@@ -0,0 +1,377 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vcokltfre/ez/ez/lexer"
+)
+
+func TestQuotas(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		setup func(*VM)
+		err   error
+	}{
+		{"variables", "a = 1\nb = 2\nc = 3", func(vm *VM) { vm.MaxVariables = 2 }, ErrVariableQuota},
+		{"builtin outputs", "call memget 0 a\ncall memget 0 b\ncall memget 0 c\ncall memget 0 d", func(vm *VM) { vm.MaxVariables = 3 }, ErrVariableQuota},
+		{"builtin outputs in memory", "call memget 0 a\ncall memget 0 b", func(vm *VM) { vm.MaxMemory = 17 }, ErrMemoryQuota},
+		{"locals", "g = 1\nfunc f(a, b)\n  return a\nend\nx = f(1, 2)", func(vm *VM) { vm.MaxVariables = 2 }, ErrVariableQuota},
+		{"unassigned globals", "if 1 goto skip\nb = 2\nc = 3\n:skip\na = 1", func(vm *VM) { vm.MaxVariables = 1 }, nil},
+		{"generated", "n = 3\nfor i = 1 to n step n\nend", func(vm *VM) { vm.MaxVariables = 2 }, nil},
+		{"generated locals", "func f(n)\n  for i = 1 to n step n\n  end\n  return i\nend\nx = f(3)", func(vm *VM) { vm.MaxVariables = 3 }, nil},
+		{"within limits", "call memget 0 a\ncall memget 0 b", func(vm *VM) { vm.MaxVariables = 3 }, nil},
+		{"steps", "l = 0\n:loop\ngoto loop", func(vm *VM) { vm.MaxSteps = 100 }, ErrStepLimit},
+		{"depth", "func f(n)\n  return f(n)\nend\nx = f(1)", func(vm *VM) { vm.MaxDepth = 10 }, ErrDepthLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+			vm.Stdout = io.Discard
+			test.setup(vm)
+
+			err := vm.Exec(compileSource(t, vm, test.code))
+			if test.err == nil && err != nil || !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestOutputArgumentsInFunctionsAreLocal(t *testing.T) {
+	vm := New(16)
+	vm.Stdout = io.Discard
+
+	err := vm.Exec(compileSource(t, vm, "g = 5\nfunc f(a)\n  call memset 0 a\n  call memget 0 g\n  return g + 1\nend\nr = f(3)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, _ := vm.Variables.Get("g"); g != 5 {
+		t.Fatalf("global g = %d, want 5", g)
+	}
+
+	if r, _ := vm.Variables.Get("r"); r != 4 {
+		t.Fatalf("r = %d, want 4", r)
+	}
+}
+
+// run compiles and runs code on a fresh VM, returning the VM for inspection.
+func run(t *testing.T, code string) (*VM, error) {
+	t.Helper()
+
+	vm := New(16)
+	vm.Stdout = io.Discard
+
+	return vm, vm.Exec(compileSource(t, vm, code))
+}
+
+// Compiled programs leave behind the globals the statements they come from
+// assign, and no others.
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		code string
+		vars map[string]int64
+	}{
+		{"a = 2 + 3 * 4\nb = (2 + 3) * 4\nc = 2 - 3 - 4", map[string]int64{"a": 14, "b": 20, "c": -5}},
+		{"s = 0\nfor i = 1 to 10\n  if i % 2 == 0 then\n    continue\n  end\n  s = s + i\nend", map[string]int64{"s": 25, "i": 11}},
+		{"n = 3\nwhile n > 0 do\n  n = n - 1\nend", map[string]int64{"n": 0}},
+		{"func fact(n)\n  if n <= 1 then\n    return 1\n  end\n  return n * fact(n - 1)\nend\na = fact(10)", map[string]int64{"a": 3628800}},
+		{"x = 1\nfunc f(a)\n  x = a * 2\n  return x\nend\ny = f(5)", map[string]int64{"x": 1, "y": 10}},
+		{"x = 5\ngosub sub\ngoto done\n:sub\nx = x + 1\nreturn\n:done", map[string]int64{"x": 6}},
+		{"call memset 3 6 * 7\ncall memget 3 a", map[string]int64{"a": 42}},
+		{"n = 3\ns = 0\nfor i = n to 1 step -1\n  s = s + i\nend", map[string]int64{"n": 3, "s": 6, "i": 0}},
+		{"d = 2\nfor i = 1 to 5 step d\nend", map[string]int64{"d": 2, "i": 7}},
+	}
+
+	for _, test := range tests {
+		vm, err := run(t, test.code)
+		if err != nil {
+			t.Fatalf("%q: %v", test.code, err)
+		}
+
+		got := vm.Variables.Map()
+		delete(got, "__memsize")
+
+		if !maps.Equal(got, test.vars) {
+			t.Errorf("%q: globals %v, want %v", test.code, got, test.vars)
+		}
+	}
+}
+
+func TestCompiledBuiltinCalls(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		setup func(*VM)
+		err   string
+	}{
+		{"bad argument not reached", "goto skip\ncall memget 0 \"x\"\n:skip", nil, ""},
+		{"bad argument reached", "x = 1\ncall memget 0 \"x\"", nil, "expected identifier"},
+		{"wrong arity reached", "call memset 0", nil, "incorrect number of arguments"},
+		{"signature changed", "call f 1", func(vm *VM) { vm.RegisterFunc("f", Signature{Out("x")}, nil) }, "signature changed"},
+		{"removed after compiling", "call shown 1", func(vm *VM) { delete(vm.Funcs, "shown") }, "function does not exist"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vm := New(16)
+			vm.Stdout = io.Discard
+			vm.RegisterFunc("f", Signature{In("x")}, func(ctx lexer.TokenContext, args []Arg) error { return nil })
+
+			code := compileSource(t, vm, test.code)
+			if test.setup != nil {
+				test.setup(vm)
+			}
+
+			err := vm.Exec(code)
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// evaluate runs an assignment of expr and returns the value assigned.
+func evaluate(t *testing.T, expr string) (int64, error) {
+	t.Helper()
+
+	vm, err := run(t, "r = "+expr)
+	r, _ := vm.Variables.Get("r")
+
+	return r, err
+}
+
+func TestPowerAndBitwise(t *testing.T) {
+	tests := map[string]int64{
+		"2 ^ 10":       1024,
+		"3 ^ 0":        1,
+		"-2 ^ 3":       -8,
+		"2 ^ 3 ^ 2":    512,
+		"2 * 3 ^ 2":    18,
+		"12 & 10":      8,
+		"12 | 10":      14,
+		"12 xor 10":    6,
+		"~0":           -1,
+		"~5 & 0xFF":    250,
+		"1 << 4":       16,
+		"-16 >> 2":     -4,
+		"-1 >>> 60":    15,
+		"1 + 1 << 2":   8,
+		"6 & 3 == 2":   1,
+		"1 << 62 >> 1": 1 << 61,
+	}
+
+	for expr, want := range tests {
+		if got, err := evaluate(t, expr); err != nil || got != want {
+			t.Errorf("%s = %d, %v; want %d", expr, got, err, want)
+		}
+	}
+}
+
+func TestPowerOverflow(t *testing.T) {
+	if _, err := evaluate(t, "2 ^ 63"); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("2 ^ 63: got %v, want %v", err, ErrOverflow)
+	}
+
+	if got, err := evaluate(t, "(-2) ^ 63"); err != nil || got != math.MinInt64 {
+		t.Fatalf("(-2) ^ 63 = %d, %v; want %d", got, err, int64(math.MinInt64))
+	}
+
+	for _, expr := range []string{"2 ^ -1", "1 << -1"} {
+		if _, err := evaluate(t, expr); err == nil || !strings.Contains(err.Error(), "negative") {
+			t.Errorf("%s: got %v, want a negative operand error", expr, err)
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	if _, err := evaluate(t, "1 / (2 - 2)"); !errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("division: got %v, want %v", err, ErrDivisionByZero)
+	}
+
+	if _, err := evaluate(t, "1 % (2 - 2)"); !errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("modulo: got %v, want %v", err, ErrDivisionByZero)
+	}
+
+	if _, err := evaluate(t, "(-9223372036854775807 - 1) / -1"); !errors.Is(err, ErrOverflow) {
+		t.Errorf("minimum divided by -1: got %v, want %v", err, ErrOverflow)
+	}
+
+	// Other arithmetic wraps around like int64.
+	if got, err := evaluate(t, "9223372036854775807 + 1"); err != nil || got != math.MinInt64 {
+		t.Errorf("maximum + 1 = %d, %v; want %d", got, err, int64(math.MinInt64))
+	}
+
+	var diag lexer.Diagnostic
+
+	_, err := evaluate(t, "7 / (1 - 1)")
+	if !errors.As(err, &diag) || diag.Step != "runtime" || diag.Context.Line != 1 || diag.Context.Column != 7 {
+		t.Errorf("division by zero is not positioned at the operator: %#v", err)
+	}
+}
+
+func TestHostPanic(t *testing.T) {
+	vm := New(16)
+	vm.RegisterFunc("boom", nil, func(ctx lexer.TokenContext, args []Arg) error {
+		panic("host bug")
+	})
+
+	err := vm.Exec(compileSource(t, vm, "x = 1\ncall boom"))
+	if err == nil || !strings.Contains(err.Error(), "panic: host bug") {
+		t.Fatalf("got %v, want the panic as a runtime error", err)
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := map[string]int64{
+		"2 and 3":        1,
+		"2 and 0":        0,
+		"0 or 0":         0,
+		"0 or -7":        1,
+		"not 5":          0,
+		"not 0":          1,
+		"1 < 2 and 3":    1,
+		"not 1 == 2":     1,
+		"0 or 1 and 0":   0,
+		"(0 or 1) and 2": 1,
+	}
+
+	for expr, want := range tests {
+		if got, err := evaluate(t, expr); err != nil || got != want {
+			t.Errorf("%s = %d, %v; want %d", expr, got, err, want)
+		}
+	}
+}
+
+// The right operand of and/or only runs when the left one does not decide the
+// result, which the output of a function with a side effect shows.
+func TestShortCircuit(t *testing.T) {
+	var out strings.Builder
+
+	vm := New(16)
+	vm.Stdout = &out
+
+	code := "func f(n)\n  call shown n\n  return n\nend\n" +
+		"a = 0 and f(1)\nb = 1 and f(2)\nc = 1 or f(3)\nd = 0 or f(4)\n" +
+		"if f(0) and f(5) goto skip\ne = 1\n:skip"
+
+	if err := vm.Exec(compileSource(t, vm, code)); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "240" {
+		t.Fatalf("functions called: %q, want %q", out.String(), "240")
+	}
+
+	if e, ok := vm.Variables.Get("e"); !ok || e != 1 {
+		t.Fatal("if jumped on a false condition")
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	vm, err := run(t, "a = 5\na += 3\na *= 2\na -= 1\na /= 3\na %= 3\nb = 1\nb <<= 3\nb |= 1\nb ^= 2\nc = 1\ninc c\ninc c\ndec c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]int64{"a": 2, "b": 81, "c": 2} {
+		if got, _ := vm.Variables.Get(name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+
+	if _, err := run(t, "a = 1\na /= 0"); !errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("a /= 0: got %v, want %v", err, ErrDivisionByZero)
+	}
+
+	if _, err := run(t, "inc missing"); err == nil || !strings.Contains(err.Error(), "variable does not exist") {
+		t.Errorf("inc of an unassigned variable: got %v", err)
+	}
+}
+
+// Counters are updated in place rather than loaded, computed and stored.
+func TestIncrementInstructions(t *testing.T) {
+	tests := []struct {
+		code string
+		op   Opcode
+	}{
+		{"x = 0\ninc x", OpIncGlobal},
+		{"x = 0\nx += 2", OpIncGlobal},
+		{"x = 0\nx = x - 1", OpIncGlobal},
+		{"func f(n)\n  dec n\n  return n\nend\nx = f(1)", OpIncLocal},
+	}
+
+	for _, test := range tests {
+		vm := New(16)
+		code := compileSource(t, vm, test.code)
+
+		if !slices.ContainsFunc(code.Instrs, func(instr Instr) bool { return instr.Op == test.op }) {
+			t.Errorf("%q does not compile to opcode %d", test.code, test.op)
+		}
+
+		if slices.ContainsFunc(code.Instrs, func(instr Instr) bool { return instr.Op == OpAdd || instr.Op == OpSub }) {
+			t.Errorf("%q compiles to a generic addition", test.code)
+		}
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	loop := ":loop\ngoto loop"
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	for ctx, want := range map[context.Context]error{cancelled: ErrCancelled, expired: ErrTimeout} {
+		vm := New(16)
+
+		start := time.Now()
+		if err := vm.ExecContext(ctx, compileSource(t, vm, loop)); !errors.Is(err, want) {
+			t.Errorf("got %v, want %v", err, want)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("stopping took %v", elapsed)
+		}
+	}
+}
+
+// A loop whose bound is near the end of the integer range stops there rather
+// than wrapping around and running forever.
+func TestForNearOverflow(t *testing.T) {
+	tests := []struct {
+		code  string
+		count int64
+	}{
+		{"for i = 9223372036854775805 to 9223372036854775807\n  c += 1\nend", 3},
+		{"for i = 9223372036854775800 to 9223372036854775807 step 5\n  c += 1\nend", 2},
+		{"for i = -9223372036854775806 to -9223372036854775807 - 1 step -1\n  c += 1\nend", 3},
+		{"s = 3\nfor i = 9223372036854775801 to 9223372036854775807 step s\n  c += 1\nend", 3},
+		{"s = -3\nfor i = -9223372036854775801 to -9223372036854775807 - 1 step s\n  c += 1\nend", 3},
+	}
+
+	for _, test := range tests {
+		vm := New(16)
+		vm.MaxSteps = 1000
+
+		if err := vm.Exec(compileSource(t, vm, "c = 0\n"+test.code)); err != nil {
+			t.Fatalf("%q: %v", test.code, err)
+		}
+
+		if c, _ := vm.Variables.Get("c"); c != test.count {
+			t.Errorf("%q: ran %d times, want %d", test.code, c, test.count)
+		}
+	}
+}
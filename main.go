@@ -1,49 +1,319 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/vcokltfre/ez/ez"
+	"github.com/vcokltfre/ez/ez/dap"
+	"github.com/vcokltfre/ez/ez/debugger"
+	"github.com/vcokltfre/ez/ez/format"
+	"github.com/vcokltfre/ez/ez/lexer"
+	"github.com/vcokltfre/ez/ez/lsp"
+	"github.com/vcokltfre/ez/ez/render"
+	"github.com/vcokltfre/ez/ez/repl"
+	"github.com/vcokltfre/ez/ez/vm"
 )
 
+type options struct {
+	memory   int
+	maxDepth int
+	format   render.Format
+	port     int
+}
+
+func parseOptions(args []string) (options, error) {
+	opts := options{
+		memory:   ez.DefaultMemory,
+		maxDepth: vm.DefaultMaxDepth,
+		format:   render.AutoFormat(os.Stderr),
+	}
+
+	values := make(map[string]string)
+	for _, arg := range args {
+		parts := strings.Split(arg, "=")
+		if len(parts) != 2 {
+			return opts, fmt.Errorf("invalid option: %s", arg)
+		}
+
+		values[parts[0]] = parts[1]
+	}
+
+	var err error
+
+	if val, ok := values["memory"]; ok {
+		opts.memory, err = strconv.Atoi(val)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if val, ok := values["depth"]; ok {
+		opts.maxDepth, err = strconv.Atoi(val)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if val, ok := values["port"]; ok {
+		opts.port, err = strconv.Atoi(val)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	if val, ok := values["format"]; ok {
+		opts.format, err = render.ParseFormat(val)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <filename> [opts]", os.Args[0])
+		fmt.Printf("Usage: %s <filename|-> [opts]\n", os.Args[0])
+		fmt.Printf("       %s repl [opts]\n", os.Args[0])
+		fmt.Printf("       %s debug <filename> [opts]\n", os.Args[0])
+		fmt.Printf("       %s dap [port=<port>] [opts]\n", os.Args[0])
+		fmt.Printf("       %s lsp\n", os.Args[0])
+		fmt.Printf("       %s fmt [-w|-d|-check] [filenames]\n", os.Args[0])
 		return
 	}
 
-	opts := make(map[string]string)
-	for i := 2; i < len(os.Args); i++ {
-		parts := strings.Split(os.Args[i], "=")
-		if len(parts) != 2 {
-			fmt.Println("Invalid option:", os.Args[i])
+	if os.Args[1] == "fmt" {
+		os.Exit(formatFiles(os.Args[2:]))
+	}
+
+	if os.Args[1] == "debug" {
+		if len(os.Args) < 3 {
+			fmt.Printf("Usage: %s debug <filename> [opts]\n", os.Args[0])
 			return
 		}
 
-		opts[parts[0]] = parts[1]
+		debugFile(os.Args[2], os.Args[3:])
+		return
 	}
 
-	data, err := os.ReadFile(os.Args[1])
+	opts, err := parseOptions(os.Args[2:])
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	memory := 1 << 16
-	if val, ok := opts["memory"]; ok {
-		memory, err = strconv.Atoi(val)
-		if err != nil {
+	switch os.Args[1] {
+	case "repl":
+		session := repl.New(os.Stdin, os.Stdout, opts.memory, opts.maxDepth, opts.format)
+		if err := session.Run(); err != nil {
 			fmt.Println(err)
-			return
+			os.Exit(1)
+		}
+	case "lsp":
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "dap":
+		if err := serveDAP(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		runFile(os.Args[1], opts)
+	}
+}
+
+// serveDAP runs a debug adapter over stdio, or over TCP on localhost when a
+// port is given, serving one client at a time.
+func serveDAP(opts options) error {
+	if opts.port == 0 {
+		return dap.NewServer(os.Stdin, os.Stdout, opts.memory, opts.maxDepth).Serve()
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", opts.port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Fprintf(os.Stderr, "Listening for DAP clients on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		err = dap.NewServer(conn, conn, opts.memory, opts.maxDepth).Serve()
+		conn.Close()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// formatFiles formats files, or stdin when none are given, and returns the
+// exit code: 1 if a file could not be formatted, or with -check if any file
+// is not formatted. The flags combine: -check lists a file, -d prints its diff
+// and -w writes it back, and the result is printed only when none is given.
+func formatFiles(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result back to the files")
+	diff := flags.Bool("d", false, "print a diff of the changes")
+	check := flags.Bool("check", false, "list files that are not formatted and exit with 1 if there are any")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "cannot use -w with standard input")
+			return 2
+		}
+
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		return formatFile("<stdin>", string(data), false, *diff, *check)
+	}
+
+	code := 0
+
+	for _, filename := range flags.Args() {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
 		}
+
+		code = max(code, formatFile(filename, string(data), *write, *diff, *check))
+	}
+
+	return code
+}
+
+// formatFile formats one file's code as the flags of formatFiles ask and
+// returns its exit code.
+func formatFile(filename, code string, write, diff, check bool) int {
+	formatted, err := format.Format(code, filename)
+	if err != nil {
+		printDiagnostics(err, render.AutoFormat(os.Stderr))
+		return 1
+	}
+
+	if !write && !diff && !check {
+		fmt.Print(formatted)
+		return 0
+	}
+
+	if formatted == code {
+		return 0
+	}
+
+	status := 0
+
+	if check {
+		fmt.Println(filename)
+		status = 1
+	}
+
+	if diff {
+		fmt.Print(format.Diff(filename, code, formatted))
+	}
+
+	if write {
+		if err := os.WriteFile(filename, []byte(formatted), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+// printDiagnostics writes to stderr, keeping them apart from the program's own
+// output when they are read by a tool.
+func printDiagnostics(err error, format render.Format) {
+	diags := lexer.Diagnostics{}
+	diags.Add(err)
+
+	if err := render.Write(os.Stderr, format, diags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func debugFile(filename string, args []string) {
+	opts, err := parseOptions(args)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	err = ez.Run(string(data), os.Args[1], memory)
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+
+	err = debugger.Run(os.Stdin, os.Stdout, string(data), filename, opts.memory, opts.maxDepth, opts.format)
+	if err != nil {
+		printDiagnostics(err, opts.format)
+		os.Exit(1)
+	}
+}
+
+func runFile(filename string, opts options) {
+	var data []byte
+	var err error
+
+	// A filename of - reads the program from stdin.
+	if filename == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	program, err := ez.Compile(string(data), filename, ez.Options{
+		Memory:   opts.memory,
+		MaxDepth: opts.maxDepth,
+		Stdin:    os.Stdin,
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+
+		Permissions: vm.Unrestricted(),
+	})
+
+	// Warnings are reported with any runtime error, so that a machine-readable
+	// format gets a single document.
+	diags := lexer.Diagnostics{}
+	if err == nil {
+		diags = append(diags, program.Warnings()...)
+		err = program.Run()
+	}
+
+	if err != nil {
+		diags.Add(err)
+	}
+
+	if len(diags) > 0 {
+		printDiagnostics(diags, opts.format)
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
 }